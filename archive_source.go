@@ -0,0 +1,99 @@
+package multipart
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveMember is a file stored uncompressed in an archive, it is a sub-range of the archive
+// so it can be served as a ReadSeekCloser without extracting it.
+type ArchiveMember struct {
+	*io.SectionReader
+	Name    string
+	ModTime time.Time
+}
+
+// Close does nothing, the archive should be closed by its owner.
+func (am *ArchiveMember) Close() error {
+	return nil
+}
+
+// OpenZipEntry finds the entry named name in the zip archive ra of size bytes,
+// only entries stored without compression or encryption can be opened.
+func OpenZipEntry(ra io.ReaderAt, size int64, name string) (*ArchiveMember, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+
+		if f.Method != zip.Store {
+			return nil, fmt.Errorf("zip entry %s is compressed by method %d", name, f.Method)
+		} else if f.Flags&0x1 != 0 {
+			return nil, fmt.Errorf("zip entry %s is encrypted", name)
+		} else if f.CompressedSize64 != f.UncompressedSize64 || f.CompressedSize64 > uint64(size) {
+			return nil, fmt.Errorf("zip entry %s has invalid size", name)
+		}
+
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		} else if offset+int64(f.CompressedSize64) > size {
+			return nil, fmt.Errorf("zip entry %s is out of the archive", name)
+		}
+		return &ArchiveMember{
+			SectionReader: io.NewSectionReader(ra, offset, int64(f.CompressedSize64)),
+			Name:          name,
+			ModTime:       f.Modified,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: zip entry %s", os.ErrNotExist, name)
+}
+
+// OpenTarMember finds the regular file named name in the tar archive ra of size bytes,
+// sparse files can not be opened because their data is not contiguous.
+func OpenTarMember(ra io.ReaderAt, size int64, name string) (*ArchiveMember, error) {
+	archive := io.NewSectionReader(ra, 0, size)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: tar member %s", os.ErrNotExist, name)
+		} else if err != nil {
+			return nil, err
+		} else if hdr.Name != name {
+			continue
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("tar member %s is not a regular file", name)
+		}
+		for key := range hdr.PAXRecords {
+			// PAX sparse files have the type of regular files
+			if strings.HasPrefix(key, "GNU.sparse.") {
+				return nil, fmt.Errorf("tar member %s is a sparse file", name)
+			}
+		}
+		// the reader stops right after the headers of the member
+		offset, err := archive.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		} else if hdr.Size > size-offset {
+			return nil, fmt.Errorf("tar member %s is out of the archive", name)
+		}
+		return &ArchiveMember{
+			SectionReader: io.NewSectionReader(ra, offset, hdr.Size),
+			Name:          name,
+			ModTime:       hdr.ModTime,
+		}, nil
+	}
+}
@@ -0,0 +1,186 @@
+package multipart
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveMember(t *testing.T) {
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	video := bytes.Repeat([]byte("0123456789"), 100)
+	longName := strings.Repeat("dir/", 40) + "video.mp4"
+
+	zipBuf := new(bytes.Buffer)
+	zw := zip.NewWriter(zipBuf)
+	for _, hdr := range []*zip.FileHeader{
+		&zip.FileHeader{Name: "readme.txt", Method: zip.Deflate},
+		&zip.FileHeader{Name: "video.mp4", Method: zip.Store, Modified: modTime},
+	} {
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write(video); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tarBuf := new(bytes.Buffer)
+	tw := tar.NewWriter(tarBuf)
+	for _, hdr := range []*tar.Header{
+		&tar.Header{Name: "readme.txt", Typeflag: tar.TypeReg, Size: 3, Mode: 0644},
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: longName, Typeflag: tar.TypeReg, Size: int64(len(video)), Mode: 0644, ModTime: modTime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(video[:hdr.Size]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// a PAX sparse member whose data starts with its sparse map, see writeSparseHeader
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeSparseHeader(t, tarBuf, "sparse.bin", 100)
+	sparseData := append([]byte("1\n0\n5\n"), make([]byte, 506)...)
+	sparseData = append(sparseData, "hello"...)
+	if err := tw.WriteHeader(&tar.Header{Name: "GNUSparseFile.0/sparse.bin", Typeflag: tar.TypeReg, Size: int64(len(sparseData)), Mode: 0644}); err != nil {
+		t.Fatal(err)
+	} else if _, err = tw.Write(sparseData); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := map[string]func(name string) (*ArchiveMember, error){
+		"zip": func(name string) (*ArchiveMember, error) {
+			return OpenZipEntry(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()), name)
+		},
+		"tar": func(name string) (*ArchiveMember, error) {
+			return OpenTarMember(bytes.NewReader(tarBuf.Bytes()), int64(tarBuf.Len()), name)
+		},
+	}
+
+	t.Run("serve ranges", func(t *testing.T) {
+		for format, name := range map[string]string{"zip": "video.mp4", "tar": longName} {
+			member, err := open[format](name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if member.Size() != int64(len(video)) || !member.ModTime.Equal(modTime) {
+				t.Errorf("%s: unexpected size(%d) mod time(%s)", format, member.Size(), member.ModTime)
+			}
+
+			mr, err := NewMultipartReaderFromRange(member, "bytes=5-14, -3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go mr.Start()
+			body, err := io.ReadAll(mr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader := multipart.NewReader(bytes.NewReader(body), mr.boundary)
+			for _, expectOut := range []string{"5678901234", "789"} {
+				part, err := reader.NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				partBody, err := io.ReadAll(part)
+				if err != nil {
+					t.Fatal(err)
+				} else if string(partBody) != expectOut {
+					t.Errorf("%s: expect(%s) got(%s)", format, expectOut, partBody)
+				}
+			}
+		}
+	})
+
+	t.Run("unsupported members", func(t *testing.T) {
+		type testCase struct {
+			format    string
+			name      string
+			notExist  bool
+			expectErr bool
+		}
+		testCases := []*testCase{
+			&testCase{format: "zip", name: "readme.txt", expectErr: true},
+			&testCase{format: "zip", name: "missing", notExist: true},
+			&testCase{format: "tar", name: "dir/", expectErr: true},
+			&testCase{format: "tar", name: "missing", notExist: true},
+			&testCase{format: "tar", name: "readme.txt", expectErr: false},
+			&testCase{format: "tar", name: "sparse.bin", expectErr: true},
+		}
+
+		for _, tc := range testCases {
+			_, err := open[tc.format](tc.name)
+			if tc.notExist != errors.Is(err, os.ErrNotExist) || (!tc.notExist && tc.expectErr != (err != nil)) {
+				t.Errorf("%s %s: unexpected error %v", tc.format, tc.name, err)
+			}
+		}
+
+		if _, err := OpenZipEntry(bytes.NewReader(tarBuf.Bytes()), int64(tarBuf.Len()), "video.mp4"); err == nil {
+			t.Error("invalid zip should fail")
+		}
+	})
+}
+
+// writeSparseHeader writes a PAX extended header of a GNU sparse file of format 1.0,
+// it is written by hand because tar.Writer doesn't write GNU.sparse records.
+func writeSparseHeader(t *testing.T, buf *bytes.Buffer, name string, realSize int64) {
+	var records string
+	for _, kv := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.realsize", strconv.FormatInt(realSize, 10)},
+	} {
+		// the length prefix counts itself
+		record := " " + kv[0] + "=" + kv[1] + "\n"
+		n := len(record) + 1
+		for len(strconv.Itoa(n))+len(record) != n {
+			n = len(strconv.Itoa(n)) + len(record)
+		}
+		records += strconv.Itoa(n) + record
+	}
+
+	hdrBuf := new(bytes.Buffer)
+	tw := tar.NewWriter(hdrBuf)
+	if err := tw.WriteHeader(&tar.Header{Name: "PaxHeaders/" + name, Typeflag: tar.TypeReg, Size: int64(len(records)), Format: tar.FormatUSTAR}); err != nil {
+		t.Fatal(err)
+	} else if _, err = tw.Write([]byte(records)); err != nil {
+		t.Fatal(err)
+	} else if err = tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// turn the header into a PAX header and update its checksum
+	block := hdrBuf.Bytes()
+	block[156] = tar.TypeXHeader
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, c := range block[:512] {
+		sum += int(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	buf.Write(block)
+}
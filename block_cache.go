@@ -0,0 +1,271 @@
+package multipart
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Prefetcher is implemented by sources which can load ranges in background,
+// a Transformer prefetches the next part while writing the current one.
+type Prefetcher interface {
+	// Prefetch starts loading bytes [start, end] and returns without waiting.
+	Prefetch(ctx context.Context, start, end int64)
+}
+
+// BlockCacheStats counts blocks, a read waiting for a block being loaded is a hit.
+type BlockCacheStats struct {
+	Hits       int64
+	Misses     int64
+	Prefetched int64
+	Evicted    int64
+}
+
+// BlockCache is a RangeSource which caches a slow source in fixed-size blocks aligned to blockSize,
+// blocks are evicted in LRU order when their total size exceeds the memory budget.
+// Blocks being loaded count against the budget too, a reader waits if all blocks in the budget are being loaded.
+// Blocks are loaded without the context of the reader so a loaded block can be used by other readers,
+// while a reader stops waiting once its context is done.
+type BlockCache struct {
+	src       RangeSource
+	size      int64
+	blockSize int64
+	maxBlocks int
+	mu        sync.Mutex
+	lru       *list.List // of *block, the front is the most recently used one
+	blocks    map[int64]*block
+	loading   int           // number of blocks being loaded
+	loaded    chan struct{} // closed and replaced when a load finishes
+	stats     BlockCacheStats
+}
+
+type block struct {
+	index int64
+	data  []byte
+	err   error
+	done  chan struct{} // closed after data or err is set
+	elem  *list.Element // nil until the block is loaded
+}
+
+// NewBlockCache returns an error if the budget can't hold a block or the size of src is unknown.
+func NewBlockCache(src RangeSource, blockSize, budget int64) (*BlockCache, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("block size must be positive")
+	} else if budget < blockSize {
+		return nil, errors.New("budget must hold at least one block")
+	}
+	size, err := rangeSourceSize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockCache{
+		src:       src,
+		size:      size,
+		blockSize: blockSize,
+		maxBlocks: int(budget / blockSize),
+		lru:       list.New(),
+		blocks:    map[int64]*block{},
+		loaded:    make(chan struct{}),
+	}, nil
+}
+
+// Size returns the size of the source when the cache is created.
+func (bc *BlockCache) Size() int64 {
+	return bc.size
+}
+
+// Stats returns a snapshot of the counters.
+func (bc *BlockCache) Stats() BlockCacheStats {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.stats
+}
+
+func (bc *BlockCache) OpenRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	if err := checkRange(start, end); err != nil {
+		return nil, err
+	}
+	return &blockReader{cache: bc, ctx: ctx, off: start, end: end}, nil
+}
+
+// Prefetch loads the blocks of bytes [start, end] concurrently,
+// at most half of the budget is used so the blocks being read are not evicted.
+func (bc *BlockCache) Prefetch(ctx context.Context, start, end int64) {
+	if checkRange(start, end) != nil || ctx.Err() != nil {
+		return
+	}
+
+	last := end / bc.blockSize
+	if limit := start/bc.blockSize + int64(bc.maxBlocks/2) - 1; last > limit {
+		last = limit
+	}
+	for index := start / bc.blockSize; index <= last; index++ {
+		bc.prefetchBlock(index)
+	}
+}
+
+func (bc *BlockCache) prefetchBlock(index int64) {
+	if index*bc.blockSize >= bc.size {
+		return
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if _, ok := bc.blocks[index]; ok {
+		return
+	} else if bc.loading >= bc.maxBlocks/2 || !bc.reserve() {
+		return
+	}
+	bc.stats.Prefetched++
+	bc.startLoading(index)
+}
+
+// block returns the loaded block at index, it waits if the block is being loaded.
+// A block failed to be loaded by another reader or a prefetch is loaded again once.
+func (bc *BlockCache) block(ctx context.Context, index int64) (*block, error) {
+	for retried := false; ; {
+		bc.mu.Lock()
+		b, ok := bc.blocks[index]
+		if !ok && !bc.reserve() {
+			// the whole budget is being loaded, wait for a block to be evictable
+			loaded := bc.loaded
+			bc.mu.Unlock()
+			select {
+			case <-loaded:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if ok {
+			bc.stats.Hits++
+			if b.elem != nil {
+				bc.lru.MoveToFront(b.elem)
+			}
+		} else {
+			bc.stats.Misses++
+			b = bc.startLoading(index)
+		}
+		bc.mu.Unlock()
+
+		select {
+		case <-b.done:
+			if b.err != nil && ok && !retried {
+				retried = true
+				continue
+			}
+			return b, b.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reserve evicts loaded blocks until one more block can be loaded in the budget,
+// it returns false if all blocks in the budget are being loaded. bc.mu must be held.
+func (bc *BlockCache) reserve() bool {
+	for bc.lru.Len()+bc.loading >= bc.maxBlocks && bc.lru.Len() > 0 {
+		bc.evictOldest()
+	}
+	return bc.loading < bc.maxBlocks
+}
+
+// evictOldest removes the least recently used block, bc.mu must be held.
+func (bc *BlockCache) evictOldest() {
+	oldest := bc.lru.Back()
+	bc.lru.Remove(oldest)
+	delete(bc.blocks, oldest.Value.(*block).index)
+	bc.stats.Evicted++
+}
+
+// startLoading loads the block at index in background, bc.mu must be held.
+func (bc *BlockCache) startLoading(index int64) *block {
+	b := &block{index: index, done: make(chan struct{})}
+	bc.blocks[index] = b
+	bc.loading++
+	go bc.load(b)
+	return b
+}
+
+func (bc *BlockCache) load(b *block) {
+	start := b.index * bc.blockSize
+	end := start + bc.blockSize - 1
+	if end >= bc.size {
+		end = bc.size - 1
+	}
+
+	rc, err := bc.src.OpenRange(context.Background(), start, end)
+	if err == nil {
+		b.data = make([]byte, end-start+1)
+		var n int
+		n, err = io.ReadFull(rc, b.data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the source is truncated, the short block makes readers fail with SourceTruncatedError
+			err = nil
+		}
+		b.data = b.data[:n]
+		rc.Close()
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	b.err = err
+	bc.loading--
+	if err != nil {
+		// failed blocks are not cached so they are loaded again by the next reader
+		delete(bc.blocks, b.index)
+	} else {
+		b.elem = bc.lru.PushFront(b)
+		for bc.lru.Len()+bc.loading > bc.maxBlocks {
+			bc.evictOldest()
+		}
+	}
+	close(b.done)
+	close(bc.loaded)
+	bc.loaded = make(chan struct{})
+}
+
+// blockReader reads bytes [off, end] from the blocks of a cache and reads ahead the next block.
+type blockReader struct {
+	cache *BlockCache
+	ctx   context.Context
+	off   int64
+	end   int64
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if br.off > br.end {
+		return 0, io.EOF
+	} else if err := br.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	bs := br.cache.blockSize
+	index := br.off / bs
+	b, err := br.cache.block(br.ctx, index)
+	if err != nil {
+		return 0, err
+	}
+	if next := (index + 1) * bs; next <= br.end {
+		br.cache.prefetchBlock(index + 1)
+	}
+
+	inBlock := br.off - index*bs
+	if inBlock >= int64(len(b.data)) {
+		return 0, io.EOF // the source is truncated
+	}
+	data := b.data[inBlock:]
+	if remaining := br.end - br.off + 1; int64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	n := copy(p, data)
+	br.off += int64(n)
+	return n, nil
+}
+
+func (br *blockReader) Close() error {
+	return nil
+}
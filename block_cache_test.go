@@ -0,0 +1,195 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readRange(src RangeSource, start, end int64) ([]byte, error) {
+	rc, err := src.OpenRange(context.Background(), start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestBlockCache(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	newStore := func() *fakeObjectStore {
+		store := newFakeObjectStore()
+		store.Put("obj", content)
+		return store
+	}
+	newCache := func(src RangeSource, blockSize, budget int64) *BlockCache {
+		cache, err := NewBlockCache(src, blockSize, budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	write := func(src RangeSource, ranges string) ([]byte, error) {
+		parts, err := ParseRange(ranges, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm, err := NewTransformerWithSource(src, parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		err = tfm.WriteBody(buf)
+		return buf.Bytes(), err
+	}
+
+	t.Run("prefetch next parts", func(t *testing.T) {
+		store := newStore()
+		cache := newCache(store.Object("obj"), 16, 64)
+		ranges := "bytes=0-9, 20-29, 90-99"
+		expectOut, err := write(NewReaderAtSource(bytes.NewReader(content), int64(len(content))), ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, expectStats := range []BlockCacheStats{
+			{Hits: 3, Misses: 1, Prefetched: 3},
+			{Hits: 7, Misses: 1, Prefetched: 3},
+		} {
+			out, err := write(cache, ranges)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, expectOut) {
+				t.Errorf("not equal 1.expected 2.got\n%s\n%s", expectOut, out)
+			}
+			if cache.Stats() != expectStats {
+				t.Errorf("%d: expect stats(%+v) got(%+v)", i, expectStats, cache.Stats())
+			}
+		}
+
+		// blocks are aligned and loaded once
+		opened := store.Opened()
+		sort.Strings(opened)
+		expectOpened := []string{"obj:0-15", "obj:16-31", "obj:80-95", "obj:96-99"}
+		if fmt.Sprint(opened) != fmt.Sprint(expectOpened) {
+			t.Errorf("expect opened(%v) got(%v)", expectOpened, opened)
+		}
+	})
+
+	t.Run("read ahead and eviction", func(t *testing.T) {
+		store := newStore()
+		cache := newCache(store.Object("obj"), 16, 32)
+		rc, err := cache.OpenRange(context.Background(), 5, 70)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, content[5:71]) {
+			t.Errorf("not equal 1.expected 2.got\n%s\n%s", content[5:71], out)
+		}
+
+		stats := cache.Stats()
+		if stats.Misses != 1 || stats.Hits != 4 || stats.Prefetched != 4 || stats.Evicted != 3 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+
+		// only the last 2 blocks are kept in the budget
+		opened := len(store.Opened())
+		if out, err = readRange(cache, 48, 79); err != nil || !bytes.Equal(out, content[48:80]) {
+			t.Fatalf("unexpected read %q %v", out, err)
+		} else if got := store.Opened()[opened:]; len(got) != 0 {
+			t.Errorf("cached blocks should not be opened again: %v", got)
+		}
+		if _, err = readRange(cache, 0, 15); err != nil {
+			t.Fatal(err)
+		} else if got := store.Opened()[opened:]; fmt.Sprint(got) != "[obj:0-15]" {
+			t.Errorf("evicted block should be opened again: %v", got)
+		}
+	})
+
+	t.Run("blocks being loaded count against the budget", func(t *testing.T) {
+		store := newStore()
+		gate := make(chan struct{})
+		store.SetGate(gate)
+		cache := newCache(store.Object("obj"), 16, 32)
+
+		var wg sync.WaitGroup
+		for i := int64(0); i < 4; i++ {
+			wg.Add(1)
+			go func(start int64) {
+				defer wg.Done()
+				out, err := readRange(cache, start, start+15)
+				if err != nil || !bytes.Equal(out, content[start:start+16]) {
+					t.Errorf("unexpected read %q %v", out, err)
+				}
+			}(i * 16)
+		}
+		for {
+			if waiting, _ := store.Waiting(); waiting >= 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(gate)
+		wg.Wait()
+
+		if _, maxWait := store.Waiting(); maxWait > 2 {
+			t.Errorf("expect at most 2 blocks being loaded got(%d)", maxWait)
+		}
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		store := newStore()
+		for _, args := range [][2]int64{{0, 64}, {-1, 64}, {16, 8}} {
+			if _, err := NewBlockCache(store.Object("obj"), args[0], args[1]); err == nil {
+				t.Errorf("block size(%d) budget(%d) should fail", args[0], args[1])
+			}
+		}
+		if _, err := NewBlockCache(store.Object("unknown"), 16, 64); err == nil {
+			t.Error("source of unknown size should fail")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		store := newStore()
+		cache := newCache(store.Object("obj"), 16, 64)
+		errInjected := errors.New("injected")
+
+		store.SetOpenErr(errInjected)
+		if _, err := write(cache, "bytes=0-9, 20-29"); !errors.Is(err, errInjected) {
+			t.Errorf("unexpected error %v", err)
+		}
+		store.SetOpenErr(nil)
+		if _, err := write(cache, "bytes=0-9, 20-29"); err != nil {
+			t.Errorf("failed blocks should be loaded again: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rc, err := cache.OpenRange(ctx, 40, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadAll(rc); !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		// the object is truncated after its size is advertised
+		store.Truncate("obj", 85)
+		_, err = write(newCache(store.Object("obj"), 16, 64), "bytes=0-9, 80-99")
+		truncated := &SourceTruncatedError{}
+		if !errors.As(err, &truncated) || truncated.Offset != 85 {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
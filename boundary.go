@@ -0,0 +1,133 @@
+package multipart
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"sync"
+)
+
+// boundaryBytes is the number of random bytes in a boundary, it is hex encoded into 60 characters.
+const boundaryBytes = 30
+
+// BoundaryGenerator generates the boundary of a multipart body of parts.
+type BoundaryGenerator interface {
+	Boundary(parts []*Part) (string, error)
+}
+
+// RandomBoundaryGenerator generates boundaries from Reader, crypto/rand is used if Reader is nil.
+type RandomBoundaryGenerator struct {
+	Reader io.Reader
+}
+
+func (g RandomBoundaryGenerator) Boundary(parts []*Part) (string, error) {
+	src := g.Reader
+	if src == nil {
+		src = rand.Reader
+	}
+
+	var buf [boundaryBytes]byte
+	if _, err := io.ReadFull(src, buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate boundary: %w", err)
+	}
+	return fmt.Sprintf("%x", buf[:]), nil
+}
+
+// SeededBoundaryGenerator generates the same sequence of boundaries for the same seed,
+// it is useful for golden tests but the boundaries are predictable.
+type SeededBoundaryGenerator struct {
+	mu  sync.Mutex
+	rnd *mathrand.Rand
+}
+
+func NewSeededBoundaryGenerator(seed int64) *SeededBoundaryGenerator {
+	return &SeededBoundaryGenerator{rnd: mathrand.New(mathrand.NewSource(seed))}
+}
+
+func (g *SeededBoundaryGenerator) Boundary(parts []*Part) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return RandomBoundaryGenerator{Reader: g.rnd}.Boundary(parts)
+}
+
+// ContentBoundaryGenerator derives the boundary from the ETag of the resource and the requested ranges,
+// so responses of the same resource and ranges are byte-identical and can be cached.
+type ContentBoundaryGenerator struct {
+	ETag string
+}
+
+func (g ContentBoundaryGenerator) Boundary(parts []*Part) (string, error) {
+	if err := checkParts(parts); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", g.ETag)
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d-%d/%s\n", part.rangeStartInt, part.rangeEndInt, part.fileSize)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:boundaryBytes]), nil
+}
+
+// errDelimiterFound stops scanning a part once the delimiter is matched.
+var errDelimiterFound = errors.New("delimiter found")
+
+// delimiterMatcher is a streaming KMP matcher, it reports whether the delimiter appears in the bytes written.
+type delimiterMatcher struct {
+	delimiter []byte
+	fallback  []int // fallback[i] is the length of the longest proper prefix of delimiter[:i+1] which is also its suffix
+	matched   int
+}
+
+func newDelimiterMatcher(boundary string) *delimiterMatcher {
+	delimiter := []byte("--" + boundary)
+	fallback := make([]int, len(delimiter))
+	for i, k := 1, 0; i < len(delimiter); i++ {
+		for k > 0 && delimiter[i] != delimiter[k] {
+			k = fallback[k-1]
+		}
+		if delimiter[i] == delimiter[k] {
+			k++
+		}
+		fallback[i] = k
+	}
+	return &delimiterMatcher{delimiter: delimiter, fallback: fallback}
+}
+
+func (dm *delimiterMatcher) Write(p []byte) (int, error) {
+	for i, c := range p {
+		for dm.matched > 0 && c != dm.delimiter[dm.matched] {
+			dm.matched = dm.fallback[dm.matched-1]
+		}
+		if c == dm.delimiter[dm.matched] {
+			dm.matched++
+		}
+		if dm.matched == len(dm.delimiter) {
+			return i + 1, errDelimiterFound
+		}
+	}
+	return len(p), nil
+}
+
+func (dm *delimiterMatcher) reset() {
+	dm.matched = 0
+}
+
+// findDelimiter returns the index of the first part which contains "--" + boundary, or -1 if there is none.
+func findDelimiter(ctx context.Context, src RangeSource, parts []*Part, boundary string) (int, error) {
+	dm := newDelimiterMatcher(boundary)
+	for i, part := range parts {
+		dm.reset()
+		err := copyRange(ctx, src, dm, part)
+		if errors.Is(err, errDelimiterFound) {
+			return i, nil
+		} else if err != nil {
+			return -1, err
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,225 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"testing"
+)
+
+func TestBoundaryGenerator(t *testing.T) {
+	newParts := func(rangeValue string) []*Part {
+		parts, err := RangeToParts(rangeValue, "text/plain", "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parts
+	}
+
+	t.Run("generated boundaries are valid", func(t *testing.T) {
+		gens := []BoundaryGenerator{
+			RandomBoundaryGenerator{},
+			NewSeededBoundaryGenerator(1),
+			ContentBoundaryGenerator{ETag: `"v1"`},
+		}
+
+		for _, gen := range gens {
+			boundary, err := gen.Boundary(newParts("bytes=0-1, 3-4"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = validateBoundary(boundary); err != nil {
+				t.Errorf("%T: %s", gen, err)
+			}
+		}
+	})
+
+	t.Run("seeded", func(t *testing.T) {
+		gen1, gen2 := NewSeededBoundaryGenerator(7), NewSeededBoundaryGenerator(7)
+		var prev string
+		for i := 0; i < 3; i++ {
+			b1, err := gen1.Boundary(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b2, err := gen2.Boundary(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b1 != b2 {
+				t.Errorf("same seed should generate the same boundaries: %s %s", b1, b2)
+			} else if b1 == prev {
+				t.Errorf("boundaries should not be repeated: %s", b1)
+			}
+			prev = b1
+		}
+	})
+
+	t.Run("content derived", func(t *testing.T) {
+		gen := ContentBoundaryGenerator{ETag: `"v1"`}
+		boundary := func(gen BoundaryGenerator, rangeValue string) string {
+			b, err := gen.Boundary(newParts(rangeValue))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+
+		if boundary(gen, "bytes=0-1, 8-") != boundary(gen, "bytes=0-1, -2") {
+			t.Error("equivalent ranges should have the same boundary")
+		}
+		if boundary(gen, "bytes=0-1, 8-") == boundary(gen, "bytes=0-1, 7-") {
+			t.Error("different ranges should have different boundaries")
+		}
+		if boundary(gen, "bytes=0-1, 8-") == boundary(ContentBoundaryGenerator{ETag: `"v2"`}, "bytes=0-1, 8-") {
+			t.Error("different ETags should have different boundaries")
+		}
+	})
+
+	t.Run("reproducible responses", func(t *testing.T) {
+		content := []byte("0123456789")
+		bodies := make([][]byte, 2)
+		for i := range bodies {
+			src := NewMockReadSeekCloser(bytes.NewReader(content))
+			mr, err := NewMultipartReaderWithGenerator(src, newParts("bytes=0-1, 3-4"), ContentBoundaryGenerator{ETag: `"v1"`})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go mr.Start()
+			if bodies[i], err = io.ReadAll(mr); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !bytes.Equal(bodies[0], bodies[1]) {
+			t.Errorf("responses should be identical\n%s\n%s", bodies[0], bodies[1])
+		}
+	})
+
+	t.Run("errors are returned", func(t *testing.T) {
+		errRand := errors.New("rand failed")
+		gen := RandomBoundaryGenerator{Reader: &failingSource{Reader: bytes.NewReader(nil), readErr: errRand}}
+		src := NewMockReadSeekCloser(bytes.NewReader([]byte("0123456789")))
+
+		if _, err := NewTransformerWithGenerator(src, newParts("bytes=0-1, 3-4"), gen); !errors.Is(err, errRand) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := NewMultipartReaderWithGenerator(src, newParts("bytes=0-1, 3-4"), gen); !errors.Is(err, errRand) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestDelimiterMatcher(t *testing.T) {
+	type testCase struct {
+		boundary  string
+		content   string
+		expectOut bool
+	}
+
+	testCases := []*testCase{
+		&testCase{boundary: "BOUNDARY", content: "abc--BOUNDARYabc", expectOut: true},
+		&testCase{boundary: "BOUNDARY", content: "--BOUNDARY", expectOut: true},
+		&testCase{boundary: "BOUNDARY", content: "abc-BOUNDARY--BOUNDAR", expectOut: false},
+		&testCase{boundary: "aab", content: "---aab", expectOut: true},
+		&testCase{boundary: "aab", content: "--a--aa--aab", expectOut: true},
+		&testCase{boundary: "aab", content: "--aa--ab", expectOut: false},
+		&testCase{boundary: "-a", content: "----a", expectOut: true},
+		&testCase{boundary: "-a", content: "-- a---", expectOut: false},
+	}
+
+	for _, tc := range testCases {
+		// writing byte by byte must have the same result as writing at once
+		for _, chunkSize := range []int{1, len(tc.content)} {
+			dm := newDelimiterMatcher(tc.boundary)
+			found := false
+			for i := 0; i < len(tc.content) && !found; i += chunkSize {
+				end := i + chunkSize
+				if end > len(tc.content) {
+					end = len(tc.content)
+				}
+				_, err := dm.Write([]byte(tc.content[i:end]))
+				found = errors.Is(err, errDelimiterFound)
+			}
+
+			if found != tc.expectOut {
+				t.Errorf("%q in %q (chunk %d): expect(%t) got(%t)", tc.boundary, tc.content, chunkSize, tc.expectOut, found)
+			}
+		}
+	}
+}
+
+func TestVerifyBoundary(t *testing.T) {
+	content := []byte("0123--BOUNDARY--456789")
+	newParts := func() []*Part {
+		parts, err := RangeToParts("bytes=0-1, 3-20", "text/plain", strconv.Itoa(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parts
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		src := NewMockReadSeekCloser(bytes.NewReader(content))
+		tfm, err := NewTransformerWithBoundary(src, newParts(), "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tfm.VerifyBoundary(nil, 3); !errors.Is(err, ErrBoundaryConflict) {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		tfm, err = NewTransformerWithBoundary(src, newParts(), "OTHER")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tfm.VerifyBoundary(nil, 0); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		src := NewMockReadSeekCloser(bytes.NewReader(content))
+		mr, err := NewMultipartReaderWithBoudary(src, newParts(), "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mr.VerifyBoundary(NewSeededBoundaryGenerator(1), 1); err != nil {
+			t.Fatal(err)
+		}
+		if mr.boundary == "BOUNDARY" {
+			t.Fatal("boundary should be regenerated")
+		}
+
+		go mr.Start()
+		body, err := io.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the CRLF which terminates the headers is not a part of the body
+		body = bytes.TrimPrefix(body, []byte("\r\n"))
+		if int64(len(body)) != mr.ContentLength() {
+			t.Errorf("content length incorrect: expect(%d) got(%d)", mr.ContentLength(), len(body))
+		}
+
+		reader := multipart.NewReader(bytes.NewReader(body), mr.boundary)
+		for i, expectOut := range []string{"01", "3--BOUNDARY--45678"} {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			partBody, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(partBody) != expectOut {
+				t.Errorf("part %d: expect(%s) got(%s)", i, expectOut, partBody)
+			}
+		}
+		if err = mr.VerifyBoundary(nil, 0); err == nil {
+			t.Error("verifying a started reader should fail")
+		}
+	})
+}
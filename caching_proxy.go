@@ -0,0 +1,303 @@
+package multipart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+)
+
+// SparseCache stores the bytes of an object at their original offsets, *os.File satisfies it.
+type SparseCache interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// CachedObject is a partially cached upstream object.
+type CachedObject struct {
+	mu          sync.Mutex
+	cache       SparseCache
+	present     RangeSet
+	size        int64
+	contentType string
+	etag        string
+	modified    string // Last-Modified of the upstream
+}
+
+func NewCachedObject(cache SparseCache, present RangeSet, size int64, contentType string) *CachedObject {
+	return &CachedObject{
+		cache:       cache,
+		present:     present,
+		size:        size,
+		contentType: contentType,
+	}
+}
+
+// Present returns the intervals which are already in the cache.
+func (co *CachedObject) Present() RangeSet {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.present
+}
+
+func (co *CachedObject) Size() int64 {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.size
+}
+
+// SetValidators sets the ETag and Last-Modified of the upstream object which the cached bytes belong to,
+// an object without validators is never revalidated.
+func (co *CachedObject) SetValidators(etag, lastModified string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.etag, co.modified = etag, lastModified
+}
+
+func (co *CachedObject) meta() (int64, string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.size, co.contentType
+}
+
+func (co *CachedObject) validators() (string, string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.etag, co.modified
+}
+
+// sameVersion reports whether the validators of a response match the cached object, co.mu must be held.
+func (co *CachedObject) sameVersion(etag, lastModified string) bool {
+	if co.etag != "" || etag != "" {
+		return co.etag == etag
+	}
+	return co.modified == lastModified
+}
+
+// revalidate drops the cached bytes if the upstream object has changed.
+func (co *CachedObject) revalidate(size int64, contentType, etag, lastModified string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if co.size == size && co.sameVersion(etag, lastModified) {
+		return
+	}
+	co.present = RangeSet{}
+	co.size, co.contentType = size, contentType
+	co.etag, co.modified = etag, lastModified
+}
+
+// CachingProxy serves range requests from cached objects
+// and only fetches the missing intervals from the upstream.
+type CachingProxy struct {
+	upstream string
+	client   *http.Client
+	newCache func(key string) (SparseCache, error)
+	mu       sync.Mutex
+	objects  map[string]*CachedObject
+}
+
+// NewCachingProxy creates a proxy of the upstream address, objects are keyed by the request path
+// and newCache is called when an object is requested at the first time.
+func NewCachingProxy(upstream string, newCache func(key string) (SparseCache, error)) *CachingProxy {
+	return &CachingProxy{
+		upstream: upstream,
+		client:   http.DefaultClient,
+		newCache: newCache,
+		objects:  map[string]*CachedObject{},
+	}
+}
+
+func (cp *CachingProxy) SetClient(client *http.Client) {
+	cp.client = client
+}
+
+// AddObject registers a cached object, e.g. a cache file restored from disk.
+func (cp *CachingProxy) AddObject(key string, obj *CachedObject) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.objects[key] = obj
+}
+
+func (cp *CachingProxy) Object(key string) (*CachedObject, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	obj, ok := cp.objects[key]
+	return obj, ok
+}
+
+func (cp *CachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	obj, err := cp.object(r.Context(), r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	size, contentType := obj.meta()
+
+	// an empty object or an invalid header is served whole
+	parts, err := ParseRangeLenient(r.Header.Get("Range"), contentType, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	wanted := RangeSet{}
+	if len(parts) > 0 {
+		wanted = PartsToRangeSet(parts)
+	} else if size > 0 {
+		wanted = NewRangeSet(Interval{Start: 0, End: size - 1})
+	}
+	if r.Method == http.MethodGet {
+		if err = cp.fill(r.Context(), r.URL.Path, obj, wanted); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	serveParts(w, r, nopCloser{io.NewSectionReader(obj.cache, 0, size)}, size, contentType, parts)
+}
+
+// object returns the cached object of key, its size and content type are fetched by HEAD if it is new.
+// A cached object with validators is revalidated by a conditional HEAD and its bytes are dropped if it has changed.
+func (cp *CachingProxy) object(ctx context.Context, key string) (*CachedObject, error) {
+	obj, cached := cp.Object(key)
+	var etag, lastModified string
+	if cached {
+		if etag, lastModified = obj.validators(); etag == "" && lastModified == "" {
+			return obj, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, cp.upstream+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	} else if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if cached && resp.StatusCode == http.StatusNotModified {
+		return obj, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream responded %s", resp.Status)
+	} else if resp.ContentLength < 0 {
+		return nil, errors.New("upstream object size is unknown")
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if validateMediaType(contentType) != nil {
+		contentType = "application/octet-stream"
+	}
+	etag, lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if cached {
+		obj.revalidate(resp.ContentLength, contentType, etag, lastModified)
+		return obj, nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if obj, ok := cp.objects[key]; ok {
+		return obj, nil
+	}
+	cache, err := cp.newCache(key)
+	if err != nil {
+		return nil, err
+	}
+	obj = NewCachedObject(cache, RangeSet{}, resp.ContentLength, contentType)
+	obj.etag, obj.modified = etag, lastModified
+	cp.objects[key] = obj
+	return obj, nil
+}
+
+// fill fetches the intervals in wanted which are not present with one Range request.
+func (cp *CachingProxy) fill(ctx context.Context, key string, obj *CachedObject, wanted RangeSet) error {
+	obj.mu.Lock()
+	defer obj.mu.Unlock()
+
+	missing := wanted.Subtract(obj.present)
+	if missing.IsEmpty() {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cp.upstream+key, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", missing.String())
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	hasValidators := obj.etag != "" || obj.modified != ""
+	if hasValidators && !obj.sameVersion(resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")) {
+		// the object changed after it was validated, its cached bytes can't be mixed with the new ones
+		obj.present = RangeSet{}
+		obj.etag, obj.modified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		return errors.New("upstream object changed while it is being fetched")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return obj.fillInterval(resp.Body, Interval{Start: 0, End: obj.size - 1})
+	case http.StatusPartialContent:
+	default:
+		return fmt.Errorf("upstream responded %s", resp.Status)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		return obj.fillContentRange(resp.Body, resp.Header.Get("Content-Range"))
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err = obj.fillContentRange(part, part.Header.Get("Content-Range")); err != nil {
+			return err
+		}
+	}
+}
+
+func (co *CachedObject) fillContentRange(src io.Reader, contentRange string) error {
+	start, end, size, err := parseContentRange(contentRange)
+	if err != nil {
+		return err
+	} else if size >= 0 && size != co.size {
+		return fmt.Errorf("upstream object size changed from %d to %d", co.size, size)
+	}
+	return co.fillInterval(src, Interval{Start: start, End: end})
+}
+
+func (co *CachedObject) fillInterval(src io.Reader, iv Interval) error {
+	_, err := io.CopyN(&offsetWriter{dst: co.cache, off: iv.Start}, src, iv.Len())
+	if err != nil {
+		return err
+	}
+	co.present = co.present.Union(NewRangeSet(iv))
+	return nil
+}
@@ -0,0 +1,525 @@
+package multipart
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+)
+
+// DefaultCheckpointInterval is the number of uncompressed bytes between the checkpoints added by BuildGzipIndex.
+const DefaultCheckpointInterval = 1 << 20
+
+// Checkpoint is a position where decompression can start. Without a window it is where a new decoder starts,
+// e.g. the start of a gzip member or of an independent zstd frame. With a window it is a deflate block
+// in the middle of a gzip member: decoding starts Bits bits after CompressedOffset with the window,
+// the last 32 KiB at most of the output before it.
+type Checkpoint struct {
+	CompressedOffset   int64
+	UncompressedOffset int64
+	Bits               uint8
+	Window             []byte
+}
+
+// CompressionIndex maps uncompressed offsets to checkpoints, it starts with the checkpoint {0, 0}.
+type CompressionIndex struct {
+	Checkpoints      []Checkpoint
+	CompressedSize   int64
+	UncompressedSize int64
+}
+
+const compressionIndexMagic = "MPCI\x02"
+
+// checkpoint returns the last checkpoint at or before the uncompressed offset off.
+func (idx *CompressionIndex) checkpoint(off int64) Checkpoint {
+	i := sort.Search(len(idx.Checkpoints), func(i int) bool { return idx.Checkpoints[i].UncompressedOffset > off })
+	return idx.Checkpoints[i-1]
+}
+
+func (idx *CompressionIndex) validate() error {
+	if len(idx.Checkpoints) == 0 {
+		return errors.New("index should start at offset 0")
+	} else if first := idx.Checkpoints[0]; first.CompressedOffset != 0 || first.UncompressedOffset != 0 || first.Bits != 0 || len(first.Window) != 0 {
+		return errors.New("index should start at offset 0")
+	}
+	prev := idx.Checkpoints[0]
+	for _, cp := range idx.Checkpoints[1:] {
+		if cp.CompressedOffset <= prev.CompressedOffset || cp.UncompressedOffset < prev.UncompressedOffset {
+			return errors.New("checkpoints are not in order")
+		} else if cp.Bits > 7 || (cp.Bits > 0 && len(cp.Window) == 0) {
+			return errors.New("invalid bit offset of checkpoint")
+		} else if len(cp.Window) > deflateWindowSize || int64(len(cp.Window)) > cp.UncompressedOffset {
+			return errors.New("invalid window of checkpoint")
+		}
+		prev = cp
+	}
+	if prev.CompressedOffset > idx.CompressedSize || prev.UncompressedOffset > idx.UncompressedSize {
+		return errors.New("checkpoints are out of the file")
+	}
+	return nil
+}
+
+// WriteTo persists the index in a compact binary form, offsets are stored as deltas and windows as they are.
+func (idx *CompressionIndex) WriteTo(w io.Writer) (int64, error) {
+	size := len(compressionIndexMagic) + (len(idx.Checkpoints)*4+3)*binary.MaxVarintLen64
+	for _, cp := range idx.Checkpoints {
+		size += len(cp.Window)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, compressionIndexMagic...)
+	buf = appendUvarint(buf, uint64(idx.CompressedSize))
+	buf = appendUvarint(buf, uint64(idx.UncompressedSize))
+	buf = appendUvarint(buf, uint64(len(idx.Checkpoints)))
+	prev := Checkpoint{}
+	for _, cp := range idx.Checkpoints {
+		buf = appendUvarint(buf, uint64(cp.CompressedOffset-prev.CompressedOffset))
+		buf = appendUvarint(buf, uint64(cp.UncompressedOffset-prev.UncompressedOffset))
+		buf = append(buf, cp.Bits)
+		buf = appendUvarint(buf, uint64(len(cp.Window)))
+		buf = append(buf, cp.Window...)
+		prev = cp
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// ReadCompressionIndex reads an index written by CompressionIndex.WriteTo.
+func ReadCompressionIndex(r io.Reader) (*CompressionIndex, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(compressionIndexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	} else if string(magic) != compressionIndexMagic {
+		return nil, errors.New("invalid compression index")
+	}
+
+	var values [3]int64
+	for i := range values {
+		v, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		} else if v > math.MaxInt64 {
+			return nil, &OverflowError{Op: "compression index"}
+		}
+		values[i] = int64(v)
+	}
+
+	idx := &CompressionIndex{CompressedSize: values[0], UncompressedSize: values[1]}
+	if values[2] > idx.CompressedSize+1 {
+		return nil, errors.New("too many checkpoints")
+	}
+	// the count is not trusted for preallocation, a corrupt index ends at EOF instead
+	prev := Checkpoint{}
+	for i := int64(0); i < values[2]; i++ {
+		var offsets [2]int64
+		for j, base := range []int64{prev.CompressedOffset, prev.UncompressedOffset} {
+			delta, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if offsets[j], ok = addLength(base, int64(delta)); delta > math.MaxInt64 || !ok {
+				return nil, &OverflowError{Op: "compression index"}
+			}
+		}
+		prev = Checkpoint{CompressedOffset: offsets[0], UncompressedOffset: offsets[1]}
+
+		bits, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		windowLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		} else if windowLen > deflateWindowSize {
+			return nil, errors.New("invalid window of checkpoint")
+		}
+		prev.Bits = bits
+		if windowLen > 0 {
+			prev.Window = make([]byte, windowLen)
+			if _, err = io.ReadFull(br, prev.Window); err != nil {
+				return nil, err
+			}
+		}
+		idx.Checkpoints = append(idx.Checkpoints, prev)
+	}
+	return idx, idx.validate()
+}
+
+// BuildGzipIndex decompresses the gzip file ra of size bytes once and adds a checkpoint at every member,
+// and at the first deflate block after every interval uncompressed bytes, so a file of one member can be
+// decompressed from the middle too. interval is DefaultCheckpointInterval if it is not positive.
+func BuildGzipIndex(ra io.ReaderAt, size, interval int64) (*CompressionIndex, error) {
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+
+	// the header, the inflater and the trailer read bytes from cr without reading ahead,
+	// so off is the position of the next member after a trailer
+	cr := &offsetByteReader{r: bufio.NewReader(io.NewSectionReader(ra, 0, size))}
+	idx := &CompressionIndex{Checkpoints: []Checkpoint{{}}, CompressedSize: size}
+	for {
+		if cr.off > 0 {
+			if _, err := cr.r.Peek(1); err == io.EOF {
+				return idx, nil
+			} else if err != nil {
+				return nil, err
+			}
+			idx.Checkpoints = append(idx.Checkpoints, Checkpoint{CompressedOffset: cr.off, UncompressedOffset: idx.UncompressedSize})
+		}
+		if err := readGzipHeader(cr); err != nil {
+			return nil, err
+		}
+
+		inf, err := newInflater(cr, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		deflateStart, memberStart := cr.off, idx.UncompressedSize
+		inf.onBlock = func(bitOffset int64) {
+			off := memberStart + inf.total
+			if off-idx.Checkpoints[len(idx.Checkpoints)-1].UncompressedOffset >= interval {
+				idx.Checkpoints = append(idx.Checkpoints, Checkpoint{
+					CompressedOffset:   deflateStart + bitOffset/8,
+					UncompressedOffset: off,
+					Bits:               uint8(bitOffset % 8),
+					Window:             inf.window(),
+				})
+			}
+		}
+
+		crc := crc32.NewIEEE()
+		n, err := io.Copy(crc, inf)
+		if err != nil {
+			return nil, err
+		}
+		idx.UncompressedSize += n
+
+		var trailer [8]byte
+		if err = inf.readTrailer(trailer[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		} else if binary.LittleEndian.Uint32(trailer[:4]) != crc.Sum32() || binary.LittleEndian.Uint32(trailer[4:]) != uint32(n) {
+			return nil, gzip.ErrChecksum
+		}
+	}
+}
+
+// readGzipHeader skips the header of a gzip member, see RFC 1952 section 2.3.
+func readGzipHeader(r *offsetByteReader) error {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return gzip.ErrHeader
+	} else if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+		return gzip.ErrHeader
+	}
+
+	const (
+		flagHeaderCRC = 1 << 1
+		flagExtra     = 1 << 2
+		flagName      = 1 << 3
+		flagComment   = 1 << 4
+	)
+	flags := header[3]
+	if flags&flagExtra != 0 {
+		var extraLen [2]byte
+		if _, err := io.ReadFull(r, extraLen[:]); err != nil {
+			return gzip.ErrHeader
+		} else if _, err = io.CopyN(io.Discard, r, int64(binary.LittleEndian.Uint16(extraLen[:]))); err != nil {
+			return gzip.ErrHeader
+		}
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		// zero-terminated strings
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return gzip.ErrHeader
+			} else if c == 0 {
+				break
+			}
+		}
+	}
+	if flags&flagHeaderCRC != 0 {
+		if _, err := io.CopyN(io.Discard, r, 2); err != nil {
+			return gzip.ErrHeader
+		}
+	}
+	return nil
+}
+
+// gzipResumer decompresses a gzip file from a checkpoint in the middle of a member,
+// the following members are decompressed by a gzip.Reader.
+type gzipResumer struct {
+	ra   io.ReaderAt
+	size int64
+	base int64 // offset of cr in the file
+	cr   *offsetByteReader
+	inf  *inflater
+	rest io.Reader
+}
+
+func newGzipResumer(ra io.ReaderAt, size int64, cp Checkpoint) (*gzipResumer, error) {
+	cr := &offsetByteReader{r: bufio.NewReader(io.NewSectionReader(ra, cp.CompressedOffset, size-cp.CompressedOffset))}
+	inf, err := newInflater(cr, uint(cp.Bits), cp.Window)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipResumer{ra: ra, size: size, base: cp.CompressedOffset, cr: cr, inf: inf}, nil
+}
+
+func (gr *gzipResumer) Read(p []byte) (int, error) {
+	if gr.rest != nil {
+		return gr.rest.Read(p)
+	}
+	n, err := gr.inf.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	// the trailer can't be checked because the member is not decompressed from its start
+	var trailer [8]byte
+	if err = gr.inf.readTrailer(trailer[:]); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	next := gr.base + gr.cr.off
+	if next >= gr.size {
+		return 0, io.EOF
+	}
+	if gr.rest, err = gzip.NewReader(bufio.NewReader(io.NewSectionReader(gr.ra, next, gr.size-next))); err != nil {
+		return 0, err
+	}
+	return gr.rest.Read(p)
+}
+
+type offsetByteReader struct {
+	r   *bufio.Reader
+	off int64
+}
+
+func (obr *offsetByteReader) Read(p []byte) (int, error) {
+	n, err := obr.r.Read(p)
+	obr.off += int64(n)
+	return n, err
+}
+
+func (obr *offsetByteReader) ReadByte() (byte, error) {
+	c, err := obr.r.ReadByte()
+	if err == nil {
+		obr.off++
+	}
+	return c, err
+}
+
+// GzipCheckpointWriter writes a gzip file which starts a new member every interval uncompressed bytes,
+// the file can be decompressed by any gzip reader and its index is known without scanning.
+type GzipCheckpointWriter struct {
+	cw       *countingWriter
+	zw       *gzip.Writer
+	interval int64
+	inMember int64
+	index    *CompressionIndex
+}
+
+// NewGzipCheckpointWriter uses DefaultCheckpointInterval if interval is not positive.
+func NewGzipCheckpointWriter(w io.Writer, interval int64) *GzipCheckpointWriter {
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	cw := &countingWriter{w: w}
+	return &GzipCheckpointWriter{
+		cw:       cw,
+		zw:       gzip.NewWriter(cw),
+		interval: interval,
+		index:    &CompressionIndex{Checkpoints: []Checkpoint{{}}},
+	}
+}
+
+func (gw *GzipCheckpointWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if gw.inMember == gw.interval {
+			if err := gw.zw.Close(); err != nil {
+				return written, err
+			}
+			gw.index.Checkpoints = append(gw.index.Checkpoints, Checkpoint{
+				CompressedOffset:   gw.cw.written,
+				UncompressedOffset: gw.index.UncompressedSize,
+			})
+			gw.zw.Reset(gw.cw)
+			gw.inMember = 0
+		}
+
+		chunk := p
+		if remaining := gw.interval - gw.inMember; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := gw.zw.Write(chunk)
+		written += n
+		gw.inMember += int64(n)
+		gw.index.UncompressedSize += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close finishes the last member, the underlying writer is not closed.
+func (gw *GzipCheckpointWriter) Close() error {
+	if err := gw.zw.Close(); err != nil {
+		return err
+	}
+	gw.index.CompressedSize = gw.cw.written
+	return nil
+}
+
+// Index returns the index of the file, it is complete after Close.
+func (gw *GzipCheckpointWriter) Index() *CompressionIndex {
+	return gw.index
+}
+
+// DecompressingSource is a ReadSeekCloser of the uncompressed content of a compressed file.
+// A seek backwards or past the next checkpoint restarts decoding from the nearest checkpoint,
+// a seek forwards in the current stretch decompresses and skips the bytes in between.
+type DecompressingSource struct {
+	ra     io.ReaderAt
+	index  *CompressionIndex
+	open   func(cp Checkpoint) (io.Reader, error) // starts decoding at a checkpoint
+	off    int64                                  // position of the reader
+	dec    io.Reader                              // nil if no decoder is started
+	decOff int64                                  // uncompressed offset of the next byte from dec
+}
+
+// NewDecompressingSource uses newReader to start decoding at checkpoints,
+// it can be any codec whose checkpoints are independent, e.g. zstd frames, so they can't have windows.
+func NewDecompressingSource(ra io.ReaderAt, index *CompressionIndex, newReader func(r io.Reader) (io.Reader, error)) (*DecompressingSource, error) {
+	if err := index.validate(); err != nil {
+		return nil, err
+	}
+	for _, cp := range index.Checkpoints {
+		if len(cp.Window) > 0 {
+			return nil, errors.New("checkpoints with windows can only be used by a gzip source")
+		}
+	}
+
+	open := func(cp Checkpoint) (io.Reader, error) {
+		section := io.NewSectionReader(ra, cp.CompressedOffset, index.CompressedSize-cp.CompressedOffset)
+		return newReader(bufio.NewReader(section))
+	}
+	return &DecompressingSource{ra: ra, index: index, open: open}, nil
+}
+
+// NewGzipSource creates a source of a gzip file, the index is built by BuildGzipIndex if it is nil.
+func NewGzipSource(ra io.ReaderAt, size int64, index *CompressionIndex) (*DecompressingSource, error) {
+	if index == nil {
+		var err error
+		if index, err = BuildGzipIndex(ra, size, DefaultCheckpointInterval); err != nil {
+			return nil, err
+		}
+	} else if index.CompressedSize != size {
+		return nil, fmt.Errorf("index is of a %d bytes file but the file has %d bytes", index.CompressedSize, size)
+	} else if err := index.validate(); err != nil {
+		return nil, err
+	}
+
+	open := func(cp Checkpoint) (io.Reader, error) {
+		if len(cp.Window) > 0 {
+			return newGzipResumer(ra, size, cp)
+		}
+		return gzip.NewReader(bufio.NewReader(io.NewSectionReader(ra, cp.CompressedOffset, size-cp.CompressedOffset)))
+	}
+	return &DecompressingSource{ra: ra, index: index, open: open}, nil
+}
+
+// Size returns the size of the uncompressed content.
+func (ds *DecompressingSource) Size() int64 {
+	return ds.index.UncompressedSize
+}
+
+func (ds *DecompressingSource) Read(p []byte) (int, error) {
+	if ds.off >= ds.index.UncompressedSize {
+		return 0, io.EOF
+	}
+	if err := ds.moveDecoder(); err != nil {
+		return 0, err
+	}
+
+	if remaining := ds.index.UncompressedSize - ds.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := ds.dec.Read(p)
+	ds.off += int64(n)
+	ds.decOff += int64(n)
+	if err != nil {
+		ds.closeDecoder()
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// moveDecoder makes the decoder ready to read from ds.off.
+func (ds *DecompressingSource) moveDecoder() error {
+	cp := ds.index.checkpoint(ds.off)
+	if ds.dec == nil || ds.off < ds.decOff || cp.UncompressedOffset > ds.decOff {
+		ds.closeDecoder()
+		dec, err := ds.open(cp)
+		if err != nil {
+			return err
+		}
+		ds.dec, ds.decOff = dec, cp.UncompressedOffset
+	}
+
+	skipped, err := io.CopyN(io.Discard, ds.dec, ds.off-ds.decOff)
+	ds.decOff += skipped
+	if err != nil {
+		ds.closeDecoder()
+	}
+	return err
+}
+
+func (ds *DecompressingSource) closeDecoder() {
+	if closer, ok := ds.dec.(io.Closer); ok {
+		closer.Close()
+	}
+	ds.dec = nil
+}
+
+func (ds *DecompressingSource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ds.off
+	case io.SeekEnd:
+		offset += ds.index.UncompressedSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	ds.off = offset
+	return offset, nil
+}
+
+// Close stops the decoder, ra is not closed.
+func (ds *DecompressingSource) Close() error {
+	ds.closeDecoder()
+	return nil
+}
@@ -0,0 +1,272 @@
+package multipart
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// readAtRecorder records the lowest offset read from a ReaderAt.
+type readAtRecorder struct {
+	io.ReaderAt
+	mu     sync.Mutex
+	lowest int64
+}
+
+func (rr *readAtRecorder) ReadAt(p []byte, off int64) (int, error) {
+	rr.mu.Lock()
+	if off < rr.lowest {
+		rr.lowest = off
+	}
+	rr.mu.Unlock()
+	return rr.ReaderAt.ReadAt(p, off)
+}
+
+func (rr *readAtRecorder) reset() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.lowest = math.MaxInt64
+}
+
+func TestDecompressingSource(t *testing.T) {
+	logs := new(bytes.Buffer)
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(logs, "2021-01-02T03:04:05Z INFO request %d served in %dms\n", i, i%97)
+	}
+	content := logs.Bytes()
+
+	compressed := new(bytes.Buffer)
+	gw := NewGzipCheckpointWriter(compressed, 8192)
+	for i := 0; i < len(content); i += 1000 {
+		end := i + 1000
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := gw.Write(content[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("index", func(t *testing.T) {
+		idx := gw.Index()
+		if len(idx.Checkpoints) != (len(content)+8191)/8192 || idx.UncompressedSize != int64(len(content)) {
+			t.Fatalf("unexpected index %d checkpoints of %d bytes", len(idx.Checkpoints), idx.UncompressedSize)
+		}
+
+		built, err := BuildGzipIndex(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), DefaultCheckpointInterval)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(built, idx) {
+			t.Errorf("not equal 1.expected 2.got\n%+v\n%+v", idx, built)
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err = idx.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		persisted, err := ReadCompressionIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(persisted, idx) {
+			t.Errorf("not equal 1.expected 2.got\n%+v\n%+v", idx, persisted)
+		}
+
+		for i := 0; i < buf.Len(); i++ {
+			if _, err = ReadCompressionIndex(bytes.NewReader(buf.Bytes()[:i])); err == nil {
+				t.Errorf("truncated index(%d) should fail", i)
+			}
+		}
+
+		for _, interval := range []int64{0, -1} {
+			buf := new(bytes.Buffer)
+			gw := NewGzipCheckpointWriter(buf, interval)
+			if _, err = gw.Write(content); err != nil {
+				t.Fatal(err)
+			} else if err = gw.Close(); err != nil {
+				t.Fatal(err)
+			} else if len(gw.Index().Checkpoints) != 1 {
+				t.Errorf("interval %d: expect the default interval got %d checkpoints", interval, len(gw.Index().Checkpoints))
+			}
+		}
+
+		// a header declaring 2^40 checkpoints of a 2^40 bytes file must not be preallocated
+		corrupt := []byte(compressionIndexMagic)
+		for _, v := range []uint64{1 << 40, 1 << 40, 1 << 40} {
+			corrupt = appendUvarint(corrupt, v)
+		}
+		if _, err = ReadCompressionIndex(bytes.NewReader(corrupt)); err == nil {
+			t.Error("corrupt index should fail")
+		}
+		if _, err = NewGzipSource(bytes.NewReader(compressed.Bytes()), int64(compressed.Len())-1, idx); err == nil {
+			t.Error("index of another file should fail")
+		}
+	})
+
+	t.Run("seek from checkpoints", func(t *testing.T) {
+		ra := &readAtRecorder{ReaderAt: bytes.NewReader(compressed.Bytes())}
+		src, err := NewGzipSource(ra, int64(compressed.Len()), gw.Index())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, off := range []int64{50000, 100, 8191, 8192, 90000, 90010, int64(len(content)) - 5} {
+			ra.reset()
+			if _, err = src.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 5)
+			if _, err = io.ReadFull(src, p); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(p, content[off:off+5]) {
+				t.Errorf("%d: expect(%s) got(%s)", off, content[off:off+5], p)
+			}
+
+			cp := gw.Index().checkpoint(off)
+			if ra.lowest != math.MaxInt64 && ra.lowest < cp.CompressedOffset {
+				t.Errorf("%d: decompressed from %d before checkpoint %d", off, ra.lowest, cp.CompressedOffset)
+			}
+		}
+	})
+
+	t.Run("seek in a single member", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		logs := new(bytes.Buffer)
+		for logs.Len() < 1<<20 {
+			fmt.Fprintf(logs, "2021-01-02T03:04:05Z INFO request %x served in %dms\n", rnd.Int63(), rnd.Intn(1000))
+		}
+		content := logs.Bytes()
+		single := new(bytes.Buffer)
+		zw := gzip.NewWriter(single)
+		if _, err := zw.Write(content); err != nil {
+			t.Fatal(err)
+		} else if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ra := &readAtRecorder{ReaderAt: bytes.NewReader(single.Bytes())}
+		idx, err := BuildGzipIndex(ra, int64(single.Len()), 64<<10)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(idx.Checkpoints) < 8 || idx.UncompressedSize != int64(len(content)) {
+			t.Fatalf("unexpected index %d checkpoints of %d bytes", len(idx.Checkpoints), idx.UncompressedSize)
+		}
+		for _, cp := range idx.Checkpoints[1:] {
+			if len(cp.Window) != deflateWindowSize {
+				t.Fatalf("checkpoint %d: unexpected window of %d bytes", cp.UncompressedOffset, len(cp.Window))
+			}
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err = idx.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		persisted, err := ReadCompressionIndex(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(persisted, idx) {
+			t.Error("persisted index is not equal")
+		}
+
+		src, err := NewGzipSource(ra, int64(single.Len()), persisted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{int64(len(content)) / 2, 100, int64(len(content)) - 5, idx.Checkpoints[3].UncompressedOffset} {
+			ra.reset()
+			if _, err = src.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			p := make([]byte, 5)
+			if _, err = io.ReadFull(src, p); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(p, content[off:off+5]) {
+				t.Errorf("%d: expect(%s) got(%s)", off, content[off:off+5], p)
+			}
+
+			cp := idx.checkpoint(off)
+			if off > 64<<10 && (ra.lowest == 0 || ra.lowest < cp.CompressedOffset) {
+				t.Errorf("%d: decompressed from %d, expect from checkpoint %d", off, ra.lowest, cp.CompressedOffset)
+			}
+		}
+
+		// the rest of the file is read through the trailer
+		if _, err = src.Seek(idx.Checkpoints[len(idx.Checkpoints)-1].UncompressedOffset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(src)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(rest, content[idx.Checkpoints[len(idx.Checkpoints)-1].UncompressedOffset:]) {
+			t.Error("unexpected rest of the file")
+		}
+
+		// members after a windowed checkpoint are decompressed too
+		twice := append(append([]byte{}, single.Bytes()...), single.Bytes()...)
+		twiceIdx, err := BuildGzipIndex(bytes.NewReader(twice), int64(len(twice)), 64<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err = NewGzipSource(bytes.NewReader(twice), int64(len(twice)), twiceIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off := int64(len(content)) - 10
+		if _, err = src.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 20)
+		if _, err = io.ReadFull(src, p); err != nil {
+			t.Fatal(err)
+		} else if expect := append(append([]byte{}, content[off:]...), content[:10]...); !bytes.Equal(p, expect) {
+			t.Errorf("expect(%s) got(%s)", expect, p)
+		}
+
+		if _, err = NewDecompressingSource(bytes.NewReader(single.Bytes()), idx, func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}); err == nil {
+			t.Error("windowed checkpoints should fail without a gzip source")
+		}
+	})
+
+	t.Run("multipart reader", func(t *testing.T) {
+		single := new(bytes.Buffer)
+		zw := gzip.NewWriter(single)
+		if _, err := zw.Write(content); err != nil {
+			t.Fatal(err)
+		} else if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, file := range [][]byte{compressed.Bytes(), single.Bytes()} {
+			src, err := NewGzipSource(bytes.NewReader(file), int64(len(file)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderFromRange(src, "bytes=90000-90099, 10-20, -30")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr.SetPreflightCheck(true)
+			go mr.Start()
+			body, err := io.ReadAll(mr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, expectOut := range [][]byte{content[90000:90100], content[10:21], content[len(content)-30:]} {
+				if !bytes.Contains(body, expectOut) {
+					t.Errorf("%q not found in body", expectOut)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package multipart
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcatSource concatenates sources into one address space, e.g. numbered chunk files of a dataset,
+// so a range can cross the boundaries between sources.
+// It implements ReadSeekCloser and io.ReaderAt, ReadAt can be called concurrently.
+type ConcatSource struct {
+	sources []ReadSeekCloser
+	starts  []int64 // starts[i] is the offset of sources[i], the last one is the total size
+	seekMu  sync.Mutex
+	mu      sync.Mutex
+	off     int64
+	closed  int32 // set atomically because ReadAt is called without locks
+}
+
+// NewConcatSource gets the sizes of sources in order, they are closed by Close.
+func NewConcatSource(sources ...ReadSeekCloser) (*ConcatSource, error) {
+	starts := make([]int64, len(sources)+1)
+	for i, src := range sources {
+		size, err := sourceSize(src)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if starts[i+1], ok = addLength(starts[i], size); !ok {
+			return nil, &OverflowError{Op: "concatenated size"}
+		}
+	}
+	return &ConcatSource{sources: sources, starts: starts}, nil
+}
+
+func (cs *ConcatSource) Size() int64 {
+	return cs.starts[len(cs.sources)]
+}
+
+// ReadAt reads from the sources which contain [off, off+len(p)),
+// io.EOF is returned if a source is shorter than its size when it was added.
+func (cs *ConcatSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	} else if atomic.LoadInt32(&cs.closed) != 0 {
+		return 0, os.ErrClosed
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= cs.Size() {
+			return n, io.EOF
+		}
+
+		// the last source which starts at or before pos, empty sources are skipped
+		i := sort.Search(len(cs.sources), func(i int) bool { return cs.starts[i+1] > pos })
+		chunk := p[n:]
+		if remaining := cs.starts[i+1] - pos; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		read, err := cs.readSource(i, chunk, pos-cs.starts[i])
+		n += read
+		if read < len(chunk) {
+			if err == nil || err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (cs *ConcatSource) readSource(i int, p []byte, off int64) (int, error) {
+	if ra, ok := cs.sources[i].(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+
+	cs.seekMu.Lock()
+	defer cs.seekMu.Unlock()
+	if _, err := cs.sources[i].Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(cs.sources[i], p)
+}
+
+func (cs *ConcatSource) Read(p []byte) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	n, err := cs.ReadAt(p, cs.off)
+	cs.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil // io.EOF is returned by the next call
+	}
+	return n, err
+}
+
+func (cs *ConcatSource) Seek(offset int64, whence int) (int64, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cs.off
+	case io.SeekEnd:
+		offset += cs.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	cs.off = offset
+	return offset, nil
+}
+
+// Close closes all sources even if some of them fail and returns the first error,
+// os.ErrClosed is returned if it is already closed.
+func (cs *ConcatSource) Close() error {
+	if !atomic.CompareAndSwapInt32(&cs.closed, 0, 1) {
+		return os.ErrClosed
+	}
+
+	var firstErr error
+	for _, src := range cs.sources {
+		if err := src.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
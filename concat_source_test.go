@@ -0,0 +1,179 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// closeRecorder records Close calls of a source and can fail them.
+type closeRecorder struct {
+	ReadSeekCloser
+	closed   int
+	closeErr error
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed++
+	return cr.closeErr
+}
+
+func TestConcatSource(t *testing.T) {
+	chunks := []string{"0123", "", "456", "789ab", "c"}
+	content := []byte("0123456789abc")
+	newSource := func() *ConcatSource {
+		sources := make([]ReadSeekCloser, 0, len(chunks))
+		for i, chunk := range chunks {
+			if i%2 == 0 {
+				sources = append(sources, NewMockReadSeekCloser(bytes.NewReader([]byte(chunk))))
+			} else {
+				// a source without ReadAt
+				sources = append(sources, &struct{ ReadSeekCloser }{NewMockReadSeekCloser(bytes.NewReader([]byte(chunk)))})
+			}
+		}
+		cs, err := NewConcatSource(sources...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+
+	t.Run("read at", func(t *testing.T) {
+		cs := newSource()
+		if cs.Size() != int64(len(content)) {
+			t.Fatalf("unexpected size %d", cs.Size())
+		}
+
+		for off := 0; off <= len(content); off++ {
+			for n := 0; n <= len(content)-off+1; n++ {
+				p := make([]byte, n)
+				read, err := cs.ReadAt(p, int64(off))
+
+				expectN := n
+				if off+n > len(content) {
+					expectN = len(content) - off
+					if err != io.EOF {
+						t.Errorf("%d+%d: expect EOF got(%v)", off, n, err)
+					}
+				} else if err != nil {
+					t.Errorf("%d+%d: unexpected error %v", off, n, err)
+				}
+				if read != expectN || !bytes.Equal(p[:read], content[off:off+expectN]) {
+					t.Errorf("%d+%d: expect(%s) got(%s)", off, n, content[off:off+expectN], p[:read])
+				}
+			}
+		}
+	})
+
+	t.Run("read and seek", func(t *testing.T) {
+		cs := newSource()
+		out, err := io.ReadAll(cs)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, content) {
+			t.Errorf("not equal 1.expected 2.got\n%s\n%s", content, out)
+		}
+
+		if off, err := cs.Seek(-4, io.SeekEnd); err != nil || off != 9 {
+			t.Fatalf("unexpected seek %d %v", off, err)
+		}
+		if off, err := cs.Seek(-6, io.SeekCurrent); err != nil || off != 3 {
+			t.Fatalf("unexpected seek %d %v", off, err)
+		}
+		p := make([]byte, 5)
+		if _, err = io.ReadFull(cs, p); err != nil || string(p) != "34567" {
+			t.Errorf("unexpected read %s %v", p, err)
+		}
+		if _, err = cs.Seek(-1, io.SeekStart); err == nil {
+			t.Error("negative position should fail")
+		}
+	})
+
+	t.Run("ranges across sources", func(t *testing.T) {
+		ranges := "bytes=2-9, 0-12, 11-, 3-4"
+		parts, err := RangeToParts(ranges, "text/plain", strconv.Itoa(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectOut := new(bytes.Buffer)
+		tfm, err := NewTransformerWithBoundary(NewMockReadSeekCloser(bytes.NewReader(content)), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		} else if err = tfm.WriteBody(expectOut); err != nil {
+			t.Fatal(err)
+		}
+
+		cs := newSource()
+		for _, src := range []RangeSource{NewReadSeekerSource(cs), NewReaderAtSource(cs, cs.Size())} {
+			tfm, err = NewTransformerWithSource(src, parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := new(bytes.Buffer)
+			if err = tfm.WriteBody(out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), expectOut.Bytes()) {
+				t.Errorf("%T: not equal 1.expected 2.got\n%s\n%s", src, expectOut, out)
+			}
+		}
+	})
+
+	t.Run("truncated source", func(t *testing.T) {
+		truncated := &failingSource{Reader: bytes.NewReader([]byte("45")), size: 3}
+		cs, err := NewConcatSource(NewMockReadSeekCloser(bytes.NewReader([]byte("0123"))), truncated, &patternSource{size: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := ParseRange("bytes=3-8", cs.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm, err := NewTransformer(cs, parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tfm.WriteBody(io.Discard)
+		truncatedErr := &SourceTruncatedError{}
+		if !errors.As(err, &truncatedErr) || truncatedErr.Offset != 6 {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err = NewConcatSource(&patternSource{size: math.MaxInt64}, &patternSource{size: 1}); err == nil {
+			t.Error("size should overflow")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		errInjected := errors.New("injected")
+		closers := []*closeRecorder{
+			&closeRecorder{ReadSeekCloser: NewMockReadSeekCloser(bytes.NewReader([]byte("01")))},
+			&closeRecorder{ReadSeekCloser: NewMockReadSeekCloser(bytes.NewReader([]byte("23"))), closeErr: errInjected},
+			&closeRecorder{ReadSeekCloser: NewMockReadSeekCloser(bytes.NewReader([]byte("45"))), closeErr: errors.New("ignored")},
+		}
+		cs, err := NewConcatSource(closers[0], closers[1], closers[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = cs.Close(); err != errInjected {
+			t.Errorf("the first error should be returned: %v", err)
+		}
+		if err = cs.Close(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("unexpected error %v", err)
+		}
+		for i, closer := range closers {
+			if closer.closed != 1 {
+				t.Errorf("source %d is closed %d times", i, closer.closed)
+			}
+		}
+		if _, err = cs.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
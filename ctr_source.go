@@ -0,0 +1,107 @@
+package multipart
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CTRSource decrypts a file encrypted by AES-CTR, the counter of any offset is computed from the IV
+// so only the bytes read are decrypted. It implements ReadSeekCloser and io.ReaderAt.
+// If the IV is stored in front of the ciphertext, ra should be an io.SectionReader of the ciphertext.
+type CTRSource struct {
+	ra    io.ReaderAt
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+	size  int64
+	off   int64
+}
+
+// NewCTRSource creates a source of the size bytes ciphertext in ra, key is an AES-128, 192 or 256 key.
+func NewCTRSource(ra io.ReaderAt, size int64, key, iv []byte) (*CTRSource, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	} else if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("IV should be %d bytes", aes.BlockSize)
+	}
+
+	src := &CTRSource{ra: ra, block: block, size: size}
+	copy(src.iv[:], iv)
+	return src, nil
+}
+
+func (cs *CTRSource) Size() int64 {
+	return cs.size
+}
+
+// streamAt returns the key stream starting at off.
+func (cs *CTRSource) streamAt(off int64) cipher.Stream {
+	// the counter is the IV plus the block index as a 128-bit big-endian integer
+	counter := cs.iv
+	carry := uint64(off / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(cs.block, counter[:])
+	if skip := off % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	return stream
+}
+
+func (cs *CTRSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	} else if off >= cs.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := cs.size - off; int64(len(p)) > remaining {
+		p, err = p[:remaining], io.EOF
+	}
+	n, readErr := cs.ra.ReadAt(p, off)
+	cs.streamAt(off).XORKeyStream(p[:n], p[:n])
+	if readErr != nil {
+		err = readErr
+	}
+	return n, err
+}
+
+func (cs *CTRSource) Read(p []byte) (int, error) {
+	n, err := cs.ReadAt(p, cs.off)
+	cs.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (cs *CTRSource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cs.off
+	case io.SeekEnd:
+		offset += cs.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	cs.off = offset
+	return offset, nil
+}
+
+// Close does nothing, ra should be closed by its owner.
+func (cs *CTRSource) Close() error {
+	return nil
+}
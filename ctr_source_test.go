@@ -0,0 +1,106 @@
+package multipart
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"strconv"
+	"testing"
+)
+
+func TestCTRSource(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	plaintext := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 100)
+	encrypt := func(iv []byte) []byte {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext := make([]byte, len(plaintext))
+		cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+		return ciphertext
+	}
+
+	ivs := map[string][]byte{
+		"zero":     make([]byte, aes.BlockSize),
+		"counter":  []byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\xff\xf0"),
+		"wrapping": bytes.Repeat([]byte{0xff}, aes.BlockSize),
+	}
+
+	t.Run("read at", func(t *testing.T) {
+		for name, iv := range ivs {
+			ciphertext := encrypt(iv)
+			src, err := NewCTRSource(bytes.NewReader(ciphertext), int64(len(ciphertext)), key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, off := range []int{0, 1, 15, 16, 17, 255, 256, 257, 4095, len(plaintext) - 3} {
+				for _, n := range []int{1, 15, 16, 33} {
+					p := make([]byte, n)
+					read, err := src.ReadAt(p, int64(off))
+					expectN := n
+					if off+n > len(plaintext) {
+						expectN = len(plaintext) - off
+						if err != io.EOF {
+							t.Errorf("%s %d+%d: expect EOF got(%v)", name, off, n, err)
+						}
+					} else if err != nil {
+						t.Fatal(err)
+					}
+
+					if !bytes.Equal(p[:read], plaintext[off:off+expectN]) {
+						t.Errorf("%s %d+%d: expect(%q) got(%q)", name, off, n, plaintext[off:off+expectN], p[:read])
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("transformer", func(t *testing.T) {
+		ranges := "bytes=3-40, 500-531, 17-17, -20"
+		parts, err := RangeToParts(ranges, "text/plain", strconv.Itoa(len(plaintext)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectOut := new(bytes.Buffer)
+		tfm, err := NewTransformerWithBoundary(NewMockReadSeekCloser(bytes.NewReader(plaintext)), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		} else if err = tfm.WriteBody(expectOut); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, iv := range ivs {
+			ciphertext := encrypt(iv)
+			src, err := NewCTRSource(bytes.NewReader(ciphertext), int64(len(ciphertext)), key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, rangeSource := range []RangeSource{NewReadSeekerSource(src), NewReaderAtSource(src, src.Size())} {
+				tfm, err := NewTransformerWithSource(rangeSource, parts, "BOUNDARY")
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := new(bytes.Buffer)
+				if err = tfm.WriteBody(out); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out.Bytes(), expectOut.Bytes()) {
+					t.Errorf("%s %T: not equal 1.expected 2.got\n%s\n%s", name, rangeSource, expectOut, out)
+				}
+			}
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		if _, err := NewCTRSource(bytes.NewReader(nil), 0, key[:5], ivs["zero"]); err == nil {
+			t.Error("invalid key should fail")
+		}
+		if _, err := NewCTRSource(bytes.NewReader(nil), 0, key, ivs["zero"][:8]); err == nil {
+			t.Error("invalid IV should fail")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package multipart
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// FormatContentDisposition formats a Content-Disposition value according to RFC 6266.
+// A file name which is not printable ASCII is percent-encoded in the filename* parameter (RFC 5987),
+// and a filename parameter with an ASCII fallback is kept for old clients.
+func FormatContentDisposition(disposition, fileName string) (string, error) {
+	if rest, ok := consumeToken(disposition); !ok || rest != "" {
+		return "", fmt.Errorf("invalid disposition %q", disposition)
+	} else if fileName == "" {
+		return disposition, nil
+	} else if !utf8.ValidString(fileName) {
+		return "", errors.New("file name is not valid UTF-8")
+	}
+
+	var b strings.Builder
+	b.WriteString(disposition)
+	b.WriteString(`; filename="`)
+	printable := true
+	for _, r := range fileName {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		default:
+			printable = false
+			b.WriteByte('_')
+		}
+	}
+	b.WriteByte('"')
+
+	if !printable {
+		b.WriteString("; filename*=UTF-8''")
+		for i := 0; i < len(fileName); i++ {
+			if c := fileName[i]; isAttrChar(c) {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// isAttrChar reports whether c can be written without percent-encoding in RFC 5987 ext-value.
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
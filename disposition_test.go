@@ -0,0 +1,140 @@
+package multipart
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentDisposition(t *testing.T) {
+	type testCase struct {
+		disposition string
+		fileName    string
+		expectOut   string
+		expectErr   bool
+	}
+
+	t.Run("format", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{
+				disposition: DispositionAttachment,
+				fileName:    "download.jpg",
+				expectOut:   `attachment; filename="download.jpg"`,
+			},
+			&testCase{
+				disposition: DispositionInline,
+				fileName:    "",
+				expectOut:   `inline`,
+			},
+			&testCase{
+				disposition: DispositionAttachment,
+				fileName:    `say "hi" \ bye.txt`,
+				expectOut:   `attachment; filename="say \"hi\" \\ bye.txt"`,
+			},
+			&testCase{
+				disposition: DispositionAttachment,
+				fileName:    "résumé 2.pdf",
+				expectOut:   `attachment; filename="r_sum_ 2.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%202.pdf`,
+			},
+			&testCase{
+				disposition: DispositionInline,
+				fileName:    "日本.txt",
+				expectOut:   `inline; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`,
+			},
+			&testCase{
+				disposition: DispositionAttachment,
+				fileName:    "a\r\nSet-Cookie: x=y",
+				expectOut:   `attachment; filename="a__Set-Cookie: x=y"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x%3Dy`,
+			},
+			&testCase{
+				disposition: "attach ment",
+				fileName:    "a.txt",
+				expectErr:   true,
+			},
+			&testCase{
+				disposition: DispositionAttachment,
+				fileName:    "\xff.txt",
+				expectErr:   true,
+			},
+		}
+
+		for _, tc := range testCases {
+			out, err := FormatContentDisposition(tc.disposition, tc.fileName)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("%q should fail", tc.fileName)
+				}
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if out != tc.expectOut {
+				t.Errorf("not equal 1.expected 2.got\n%s\n%s", tc.expectOut, out)
+			}
+			disposition, params, err := mime.ParseMediaType(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disposition != tc.disposition || params["filename"] != tc.fileName && tc.fileName != "" {
+				t.Errorf("%q is parsed as %s %v", tc.fileName, disposition, params)
+			}
+		}
+	})
+
+	t.Run("response and parts", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=0-1, 3-3", "application/pdf", "5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = parts[1].SetContentDisposition(DispositionAttachment, "résumé.pdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		mr, err := NewMultipartReaderWithBoudary(NewMockReadSeekCloser(bytes.NewReader([]byte("10110"))), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mr.SetContentDisposition(DispositionInline, "download.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		mr.SetOutputHeaders(true)
+		mr.now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+		go mr.Start()
+
+		out, err := io.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectOut := strings.ReplaceAll(`HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Content-Disposition: inline; filename="download.pdf"
+Content-Length: 278
+Content-Type: multipart/byteranges; boundary=BOUNDARY
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+
+--BOUNDARY
+Content-Type: application/octet-stream
+Content-Range: bytes 0-1/5
+
+10
+--BOUNDARY
+Content-Type: application/octet-stream
+Content-Range: bytes 3-3/5
+Content-Disposition: attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf
+
+1
+--BOUNDARY--`, "\n", "\r\n")
+		if string(out) != expectOut {
+			t.Errorf("not equal 1.expected 2.got\n%s\n%s", expectOut, out)
+		}
+
+		headBody := strings.SplitN(string(out), "\r\n\r\n", 2)
+		if mr.ContentLength() != int64(len(headBody[1])) {
+			t.Errorf("content length incorrect: expect(%d) got(%d)", len(headBody[1]), mr.ContentLength())
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package multipart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrResourceChanged = errors.New("resource changed during downloading")
+
+// DownloadState is the progress of a download, it is saved in the state file for resuming.
+type DownloadState struct {
+	URL          string `json:"url"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+	Done         string `json:"done"` // Range header format of the downloaded intervals
+}
+
+// Downloader downloads a resource in segments concurrently with Range requests.
+type Downloader struct {
+	client     *http.Client
+	segments   int
+	retries    int
+	retryDelay time.Duration
+	statePath  string
+	checkpoint int64
+}
+
+func NewDownloader(segments int) *Downloader {
+	if segments < 1 {
+		segments = 1
+	}
+	return &Downloader{
+		client:     http.DefaultClient,
+		segments:   segments,
+		retries:    3,
+		retryDelay: 100 * time.Millisecond,
+		checkpoint: 1 << 20,
+	}
+}
+
+func (d *Downloader) SetClient(client *http.Client) {
+	d.client = client
+}
+
+// SetRetries sets the number of retries of each segment and the delay between retries.
+func (d *Downloader) SetRetries(retries int, delay time.Duration) {
+	d.retries = retries
+	d.retryDelay = delay
+}
+
+// SetStateFile enables resuming, the progress is loaded from and saved into path.
+func (d *Downloader) SetStateFile(path string) {
+	d.statePath = path
+}
+
+// SetCheckpoint sets how many bytes are written between two saves of the state file,
+// so at most about this many bytes are downloaded again after a crash. It is 1 MiB by default.
+func (d *Downloader) SetCheckpoint(bytes int64) {
+	d.checkpoint = bytes
+}
+
+// Download writes the resource of url into dst. If the server doesn't support ranges,
+// it falls back to downloading the whole resource with one request.
+func (d *Downloader) Download(ctx context.Context, url string, dst io.WriterAt) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	state := &DownloadState{
+		URL:          url,
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if state.Size <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return d.downloadWhole(ctx, url, dst)
+	}
+
+	done, err := d.loadDone(state)
+	if err != nil {
+		return err
+	}
+	missing := done.Complement(state.Size)
+	if missing.IsEmpty() {
+		return nil
+	}
+	segments := planSegments(missing, d.segments)
+	progress := &downloadProgress{downloader: d, state: state, done: done}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, segment := range segments {
+		wg.Add(1)
+		go func(segment *Part) {
+			defer wg.Done()
+
+			if err := d.fetchSegment(ctx, progress, segment, dst); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+			}
+		}(segment)
+	}
+	wg.Wait()
+
+	if firstErr == ErrResourceChanged {
+		return firstErr
+	} else if firstErr != nil {
+		// keep the bytes written before the failure for resuming
+		if err = progress.save(); err != nil {
+			return fmt.Errorf("%w, and saving the progress failed: %v", firstErr, err)
+		}
+		return firstErr
+	} else if d.statePath != "" {
+		return os.Remove(d.statePath)
+	}
+	return nil
+}
+
+// downloadProgress records written bytes and saves them into the state file every checkpoint bytes.
+type downloadProgress struct {
+	mu         sync.Mutex
+	downloader *Downloader
+	state      *DownloadState
+	done       RangeSet
+	unsaved    int64
+}
+
+func (dp *downloadProgress) add(iv Interval) error {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.done = dp.done.Union(NewRangeSet(iv))
+	dp.unsaved += iv.Len()
+	if dp.unsaved < dp.downloader.checkpoint {
+		return nil
+	}
+	dp.unsaved = 0
+	return dp.downloader.saveDone(dp.state, dp.done)
+}
+
+func (dp *downloadProgress) save() error {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.unsaved = 0
+	return dp.downloader.saveDone(dp.state, dp.done)
+}
+
+// progressWriter writes into an offsetWriter and records the written bytes.
+type progressWriter struct {
+	ow       *offsetWriter
+	progress *downloadProgress
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	start := pw.ow.off
+	n, err := pw.ow.Write(p)
+	if n > 0 {
+		if saveErr := pw.progress.add(Interval{Start: start, End: start + int64(n) - 1}); err == nil {
+			err = saveErr
+		}
+	}
+	return n, err
+}
+
+// planSegments splits missing intervals into about n parts with similar sizes.
+func planSegments(missing RangeSet, n int) []*Part {
+	segmentLen := missing.TotalLength() / int64(n)
+	if missing.TotalLength()%int64(n) != 0 {
+		segmentLen++
+	}
+
+	var segments []Interval
+	for _, iv := range missing.Intervals() {
+		for start := iv.Start; start <= iv.End; start += segmentLen {
+			end := iv.End
+			if iv.End-start >= segmentLen {
+				end = start + segmentLen - 1
+			}
+			segments = append(segments, Interval{Start: start, End: end})
+		}
+	}
+
+	parts := make([]*Part, 0, len(segments))
+	for _, segment := range segments {
+		parts = append(parts, newResolvedPart("", segment.Start, segment.End, -1))
+	}
+	return parts
+}
+
+// fetchSegment downloads one segment, a failed attempt is retried from where it stopped.
+func (d *Downloader) fetchSegment(ctx context.Context, progress *downloadProgress, segment *Part, dst io.WriterAt) error {
+	pw := &progressWriter{ow: &offsetWriter{dst: dst, off: segment.rangeStartInt}, progress: progress}
+	var err error
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d.retryDelay):
+			}
+		}
+
+		err = d.fetchRange(ctx, progress.state, pw, segment.rangeEndInt)
+		if err == nil || err == ErrResourceChanged || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (d *Downloader) fetchRange(ctx context.Context, state *DownloadState, pw *progressWriter, end int64) error {
+	ow := pw.ow
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, state.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", ow.off, end))
+	if state.ETag != "" && !strings.HasPrefix(state.ETag, "W/") {
+		req.Header.Set("If-Range", state.ETag)
+	} else if state.LastModified != "" {
+		req.Header.Set("If-Range", state.LastModified)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// If-Range is not matched
+		return ErrResourceChanged
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	start, rangeEnd, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	} else if start != ow.off || rangeEnd != end {
+		return fmt.Errorf("unexpected content range %s", resp.Header.Get("Content-Range"))
+	} else if size >= 0 && size != state.Size {
+		return ErrResourceChanged
+	}
+
+	_, err = io.CopyN(pw, resp.Body, end-ow.off+1)
+	return err
+}
+
+func (d *Downloader) downloadWhole(ctx context.Context, url string, dst io.WriterAt) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	_, err = io.Copy(&offsetWriter{dst: dst}, resp.Body)
+	return err
+}
+
+// loadDone returns the downloaded intervals in the state file,
+// it is empty if the state file doesn't exist or it is for another version of the resource.
+func (d *Downloader) loadDone(state *DownloadState) (RangeSet, error) {
+	if d.statePath == "" {
+		return RangeSet{}, nil
+	}
+
+	content, err := os.ReadFile(d.statePath)
+	if os.IsNotExist(err) {
+		return RangeSet{}, nil
+	} else if err != nil {
+		return RangeSet{}, err
+	}
+
+	saved := &DownloadState{}
+	if err = json.Unmarshal(content, saved); err != nil {
+		return RangeSet{}, fmt.Errorf("invalid state file %w", err)
+	}
+	if saved.URL != state.URL ||
+		saved.Size != state.Size ||
+		saved.ETag != state.ETag ||
+		saved.LastModified != state.LastModified {
+		return RangeSet{}, nil
+	}
+	return ParseRangeSet(saved.Done, strconv.FormatInt(state.Size, 10))
+}
+
+func (d *Downloader) saveDone(state *DownloadState, done RangeSet) error {
+	if d.statePath == "" {
+		return nil
+	}
+
+	saved := *state
+	saved.Done = done.String()
+	content, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(d.statePath), filepath.Base(d.statePath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), d.statePath)
+}
@@ -0,0 +1,239 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeServer serves content with the range machinery of this package.
+type rangeServer struct {
+	mu        sync.Mutex
+	content   []byte
+	etag      string
+	failures  int32 // number of the following GET requests which fail
+	cutAfter  int64 // the single part body is aborted after this many bytes if it is positive
+	sentBytes int64
+}
+
+func (rs *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.mu.Lock()
+	content, etag := rs.content, rs.etag
+	rs.mu.Unlock()
+
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", etag)
+	sizeStr := strconv.Itoa(len(content))
+	if r.Method == http.MethodHead {
+		header.Set("Content-Length", sizeStr)
+		return
+	}
+	if atomic.AddInt32(&rs.failures, -1) >= 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rangeHeader := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	parts, err := RangeToParts(rangeHeader, "application/octet-stream", sizeStr)
+	if err != nil {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	src := NewMockReadSeekCloser(bytes.NewReader(content))
+	switch len(parts) {
+	case 0:
+		w.WriteHeader(http.StatusOK)
+		n, _ := io.Copy(w, src)
+		atomic.AddInt64(&rs.sentBytes, n)
+	case 1:
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", parts[0].rangeStartInt, parts[0].rangeEndInt, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		if cutAfter := atomic.LoadInt64(&rs.cutAfter); cutAfter > 0 && cutAfter < parts[0].Len() {
+			src.Seek(parts[0].Start(), io.SeekStart)
+			io.CopyN(w, src, cutAfter)
+			atomic.AddInt64(&rs.sentBytes, cutAfter)
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		writePartBody(src, w, parts[0])
+		atomic.AddInt64(&rs.sentBytes, parts[0].rangeEndInt-parts[0].rangeStartInt+1)
+	default:
+		tfm, err := NewTransformer(src, parts)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		header.Set("Content-Type", multipartContentType(tfm.boundary))
+		w.WriteHeader(http.StatusPartialContent)
+		tfm.WriteBody(w)
+	}
+}
+
+func TestDownloader(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	newServer := func() (*rangeServer, *httptest.Server) {
+		rs := &rangeServer{content: content, etag: `"v1"`}
+		return rs, httptest.NewServer(rs)
+	}
+
+	t.Run("segments are downloaded with retries", func(t *testing.T) {
+		for _, segments := range []int{1, 3, 7, 2000} {
+			rs, server := newServer()
+			rs.failures = 2
+
+			dst := &memCache{}
+			downloader := NewDownloader(segments)
+			downloader.SetRetries(3, time.Millisecond)
+			if err := downloader.Download(context.Background(), server.URL, dst); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+
+			if string(dst.buf) != string(content) {
+				t.Errorf("segments(%d): content not equal", segments)
+			}
+		}
+	})
+
+	t.Run("resume from state file", func(t *testing.T) {
+		rs, server := newServer()
+		defer server.Close()
+
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		state, err := json.Marshal(&DownloadState{URL: server.URL, Size: int64(len(content)), ETag: `"v1"`, Done: "bytes=0-599"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(statePath, state, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := &memCache{}
+		dst.WriteAt(content[:600], 0)
+		downloader := NewDownloader(4)
+		downloader.SetStateFile(statePath)
+		if err := downloader.Download(context.Background(), server.URL, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(dst.buf) != string(content) {
+			t.Error("content not equal")
+		}
+		if atomic.LoadInt64(&rs.sentBytes) != 400 {
+			t.Errorf("only missing bytes should be downloaded: expect(400) got(%d)", atomic.LoadInt64(&rs.sentBytes))
+		}
+		if _, err = os.Stat(statePath); !os.IsNotExist(err) {
+			t.Error("state file should be removed after downloading")
+		}
+	})
+
+	t.Run("partial segment is saved", func(t *testing.T) {
+		rs, server := newServer()
+		defer server.Close()
+		rs.cutAfter = 450
+
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		downloader := NewDownloader(1)
+		downloader.SetRetries(0, time.Millisecond)
+		downloader.SetStateFile(statePath)
+		downloader.SetCheckpoint(100)
+		dst := &memCache{}
+		if err := downloader.Download(context.Background(), server.URL, dst); err == nil {
+			t.Fatal("the aborted segment should fail")
+		}
+
+		content, err := os.ReadFile(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := &DownloadState{}
+		if err = json.Unmarshal(content, state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Done != "bytes=0-449" {
+			t.Fatalf("expect done(bytes=0-449) got(%s)", state.Done)
+		}
+
+		atomic.StoreInt64(&rs.cutAfter, 0)
+		if err := downloader.Download(context.Background(), server.URL, dst); err != nil {
+			t.Fatal(err)
+		}
+		if got := atomic.LoadInt64(&rs.sentBytes); got != 1000 {
+			t.Errorf("only the rest of the segment should be downloaded again: expect(1000) got(%d)", got)
+		}
+	})
+
+	t.Run("stale state file is ignored", func(t *testing.T) {
+		rs, server := newServer()
+		defer server.Close()
+
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		state, err := json.Marshal(&DownloadState{URL: server.URL, Size: int64(len(content)), ETag: `"v0"`, Done: "bytes=0-599"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(statePath, state, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dst := &memCache{}
+		downloader := NewDownloader(4)
+		downloader.SetStateFile(statePath)
+		if err := downloader.Download(context.Background(), server.URL, dst); err != nil {
+			t.Fatal(err)
+		}
+		if string(dst.buf) != string(content) || atomic.LoadInt64(&rs.sentBytes) != int64(len(content)) {
+			t.Error("the whole resource should be downloaded again")
+		}
+	})
+
+	t.Run("resource changed", func(t *testing.T) {
+		rs, server := newServer()
+		defer server.Close()
+
+		statePath := filepath.Join(t.TempDir(), "state.json")
+		downloader := NewDownloader(4)
+		downloader.SetStateFile(statePath)
+		downloader.SetClient(&http.Client{
+			Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					rs.mu.Lock()
+					rs.etag = `"v2"`
+					rs.mu.Unlock()
+				}
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		})
+
+		err := downloader.Download(context.Background(), server.URL, &memCache{})
+		if err != ErrResourceChanged {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
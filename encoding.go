@@ -0,0 +1,170 @@
+package multipart
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNotAcceptable = errors.New("no acceptable content encoding")
+
+// Sibling is a precompressed file next to the original one, e.g. "app.js.gz" of "app.js".
+type Sibling struct {
+	Encoding string
+	Suffix   string
+}
+
+// DefaultSiblings are tried in this order if the client accepts them equally.
+var DefaultSiblings = []Sibling{
+	{Encoding: "br", Suffix: ".br"},
+	{Encoding: "gzip", Suffix: ".gz"},
+}
+
+// Representation is the file selected for a request, ranges and sizes refer to its encoded bytes.
+type Representation struct {
+	Name     string // name of the selected file
+	Encoding string // content coding, it is empty for identity
+	File     ReadSeekCloser
+	Size     int64
+	ModTime  time.Time // it is zero if the file has no Stat
+}
+
+// ETag is a strong entity tag of the representation, it differs among encodings of the same file.
+// It is empty if ModTime is zero, e.g. files of embed.FS, because the size can't tell versions apart.
+func (rep *Representation) ETag() string {
+	if rep.ModTime.IsZero() {
+		return ""
+	} else if rep.Encoding == "" {
+		return fmt.Sprintf(`"%x-%x"`, rep.ModTime.UnixNano(), rep.Size)
+	}
+	return fmt.Sprintf(`"%x-%x-%s"`, rep.ModTime.UnixNano(), rep.Size, rep.Encoding)
+}
+
+// SelectRepresentation negotiates the content coding with Accept-Encoding and opens the file of it,
+// a sibling which does not exist is skipped, and name itself is the identity fallback.
+// DefaultSiblings are used if siblings is nil, ErrNotAcceptable is returned if identity is refused
+// and no acceptable sibling exists.
+func SelectRepresentation(open func(name string) (ReadSeekCloser, error), name, acceptEncoding string, siblings []Sibling) (*Representation, error) {
+	if siblings == nil {
+		siblings = DefaultSiblings
+	}
+
+	for _, sibling := range rankEncodings(acceptEncoding, siblings) {
+		file, err := open(name + sibling.Suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return newRepresentation(name+sibling.Suffix, sibling.Encoding, file)
+	}
+
+	if q, ok := acceptEncodingQ(parseAcceptEncoding(acceptEncoding), "identity"); ok && q == 0 {
+		return nil, ErrNotAcceptable
+	}
+	file, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	return newRepresentation(name, "", file)
+}
+
+func newRepresentation(name, encoding string, file ReadSeekCloser) (*Representation, error) {
+	size, err := sourceSize(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	rep := &Representation{Name: name, Encoding: encoding, File: file, Size: size}
+	if stater, ok := file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := stater.Stat(); err == nil {
+			rep.ModTime = info.ModTime()
+		}
+	}
+	return rep, nil
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(headers textproto.MIMEHeader, field string) {
+	for _, value := range headers.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, field) {
+				return
+			}
+		}
+	}
+	headers.Add("Vary", field)
+}
+
+// rankEncodings returns the acceptable siblings ordered by the qvalue and then by the order of siblings,
+// identity is preferred only if its qvalue is given explicitly and higher.
+func rankEncodings(acceptEncoding string, siblings []Sibling) []Sibling {
+	qvalues := parseAcceptEncoding(acceptEncoding)
+	identityQ, _ := acceptEncodingQ(qvalues, "identity")
+
+	type ranked struct {
+		sibling Sibling
+		q       float64
+	}
+	var candidates []ranked
+	for _, sibling := range siblings {
+		if q, ok := acceptEncodingQ(qvalues, sibling.Encoding); ok && q > 0 && q >= identityQ {
+			candidates = append(candidates, ranked{sibling: sibling, q: q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	out := make([]Sibling, 0, len(candidates))
+	for _, candidate := range candidates {
+		out = append(out, candidate.sibling)
+	}
+	return out
+}
+
+// parseAcceptEncoding maps lower case codings to their qvalues, invalid elements are ignored.
+func parseAcceptEncoding(value string) map[string]float64 {
+	qvalues := map[string]float64{}
+	for _, elem := range strings.Split(value, ",") {
+		params := strings.Split(elem, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if rest, ok := consumeToken(coding); !ok || rest != "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(strings.ToLower(param), "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				q = -1
+				break
+			}
+			q = v
+		}
+		if q >= 0 {
+			qvalues[coding] = q
+		}
+	}
+	return qvalues
+}
+
+// acceptEncodingQ returns the qvalue of coding, "*" matches codings which are not listed.
+func acceptEncodingQ(qvalues map[string]float64, coding string) (float64, bool) {
+	if q, ok := qvalues[coding]; ok {
+		return q, true
+	}
+	q, ok := qvalues["*"]
+	return q, ok
+}
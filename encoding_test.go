@@ -0,0 +1,144 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectRepresentation(t *testing.T) {
+	files := map[string]string{
+		"app.js":     "console.log('identity identity identity')",
+		"app.js.gz":  "gzip bytes",
+		"app.js.br":  "br bytes",
+		"doc.txt":    "plain text",
+		"img.png":    "png",
+		"img.png.gz": "png in gzip",
+	}
+	open := func(name string) (ReadSeekCloser, error) {
+		content, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+		}
+		return NewMockReadSeekCloser(bytes.NewReader([]byte(content))), nil
+	}
+
+	t.Run("negotiation", func(t *testing.T) {
+		type testCase struct {
+			name           string
+			acceptEncoding string
+			expectName     string
+			expectErr      error
+		}
+		testCases := []*testCase{
+			&testCase{name: "app.js", acceptEncoding: "", expectName: "app.js"},
+			&testCase{name: "app.js", acceptEncoding: "gzip", expectName: "app.js.gz"},
+			&testCase{name: "app.js", acceptEncoding: "gzip, deflate, br", expectName: "app.js.br"},
+			&testCase{name: "app.js", acceptEncoding: "br;q=0.5, gzip;q=0.8", expectName: "app.js.gz"},
+			&testCase{name: "app.js", acceptEncoding: "X-GZIP", expectName: "app.js.gz"},
+			&testCase{name: "app.js", acceptEncoding: "*", expectName: "app.js.br"},
+			&testCase{name: "app.js", acceptEncoding: "*, br;q=0", expectName: "app.js.gz"},
+			&testCase{name: "app.js", acceptEncoding: "gzip;q=0.5, identity", expectName: "app.js"},
+			&testCase{name: "app.js", acceptEncoding: "gzip;q=2, br;q=abc", expectName: "app.js"},
+			&testCase{name: "doc.txt", acceptEncoding: "gzip, br", expectName: "doc.txt"},
+			&testCase{name: "img.png", acceptEncoding: "br, gzip;q=0.9", expectName: "img.png.gz"},
+			&testCase{name: "doc.txt", acceptEncoding: "gzip, identity;q=0", expectErr: ErrNotAcceptable},
+			&testCase{name: "doc.txt", acceptEncoding: "*;q=0", expectErr: ErrNotAcceptable},
+			&testCase{name: "missing.txt", acceptEncoding: "gzip", expectErr: os.ErrNotExist},
+		}
+
+		for _, tc := range testCases {
+			rep, err := SelectRepresentation(open, tc.name, tc.acceptEncoding, nil)
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Errorf("%s %q: expect error(%v) got(%v)", tc.name, tc.acceptEncoding, tc.expectErr, err)
+				}
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if rep.Name != tc.expectName || rep.Size != int64(len(files[tc.expectName])) {
+				t.Errorf("%s %q: expect(%s) got(%s, %d bytes)", tc.name, tc.acceptEncoding, tc.expectName, rep.Name, rep.Size)
+			}
+			if expectEncoding := map[string]string{".gz": "gzip", ".br": "br"}[strings.TrimPrefix(rep.Name, tc.name)]; rep.Encoding != expectEncoding {
+				t.Errorf("%s %q: unexpected encoding %q", tc.name, tc.acceptEncoding, rep.Encoding)
+			}
+		}
+	})
+
+	t.Run("response headers", func(t *testing.T) {
+		etags := map[string]bool{}
+		for _, acceptEncoding := range []string{"gzip", "br", ""} {
+			rep, err := SelectRepresentation(open, "app.js", acceptEncoding, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the mock files have no Stat
+			rep.ModTime = time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+			etags[rep.ETag()] = true
+
+			parts, err := ParseRange("bytes=2-5", rep.Size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderWithBoudary(rep.File, parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr.SetOutputHeaders(true)
+			if err = mr.SetHeader("Vary", "Origin"); err != nil {
+				t.Fatal(err)
+			}
+			if err = mr.SetRepresentation(rep); err != nil {
+				t.Fatal(err)
+			}
+
+			go mr.Start()
+			out, err := io.ReadAll(mr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectHeaders := []string{
+				fmt.Sprintf("Content-Range: bytes 2-5/%d\r\n", rep.Size),
+				"Vary: Origin\r\nVary: Accept-Encoding\r\n",
+				fmt.Sprintf("Etag: %s\r\n", rep.ETag()),
+			}
+			if rep.Encoding != "" {
+				expectHeaders = append(expectHeaders, fmt.Sprintf("Content-Encoding: %s\r\n", rep.Encoding))
+			} else if strings.Contains(string(out), "Content-Encoding") {
+				t.Errorf("identity should not have Content-Encoding:\n%s", out)
+			}
+			for _, header := range expectHeaders {
+				if !strings.Contains(string(out), header) {
+					t.Errorf("%q not found in\n%s", header, out)
+				}
+			}
+			if !strings.HasSuffix(string(out), "\r\n\r\n"+files[rep.Name][2:6]) {
+				t.Errorf("unexpected body\n%s", out)
+			}
+		}
+
+		if len(etags) != 3 {
+			t.Errorf("ETags should differ among encodings: %v", etags)
+		}
+	})
+
+	t.Run("managed headers", func(t *testing.T) {
+		mr, err := NewMultipartReader(NewMockReadSeekCloser(bytes.NewReader([]byte("0123"))), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mr.SetHeader("Content-Encoding", "gzip"); err == nil {
+			t.Error("Content-Encoding should be managed")
+		}
+		if err = mr.SetContentEncoding("gzip\r\nX: 1"); err == nil {
+			t.Error("invalid encoding should fail")
+		}
+	})
+}
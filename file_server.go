@@ -0,0 +1,298 @@
+package multipart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotSeekable = errors.New("file is not seekable")
+
+// FileServer serves the files of an fs.FS with range, conditional and HEAD requests.
+// Directories are served by their index.html, files which are not seekable are served whole.
+type FileServer struct {
+	fsys     fs.FS
+	siblings []Sibling
+}
+
+func NewFileServer(fsys fs.FS) *FileServer {
+	return &FileServer{fsys: fsys, siblings: []Sibling{}}
+}
+
+// SetPrecompressed enables serving precompressed siblings, see SelectRepresentation.
+// DefaultSiblings are used if siblings is nil.
+func (fsv *FileServer) SetPrecompressed(siblings []Sibling) {
+	if siblings == nil {
+		siblings = DefaultSiblings
+	}
+	fsv.siblings = siblings
+}
+
+func (fsv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := cleanPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	rep, err := fsv.representation(name, r.Header.Get("Accept-Encoding"))
+	if errors.Is(err, fs.ErrInvalid) {
+		// a directory, it is served by its index
+		name = path.Join(name, "index.html")
+		rep, err = fsv.representation(name, r.Header.Get("Accept-Encoding"))
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotSeekable):
+		fsv.serveWhole(w, r, name)
+		return
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	case errors.Is(err, ErrNotAcceptable):
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rep.File.Close()
+
+	header := w.Header()
+	setValidators(header, rep.ETag(), rep.ModTime)
+	if len(fsv.siblings) > 0 {
+		addVary(textproto.MIMEHeader(header), "Accept-Encoding")
+	}
+	if code := checkPreconditions(r, rep.ETag(), rep.ModTime); code != 0 {
+		if code == http.StatusNotModified {
+			w.WriteHeader(code)
+		} else {
+			http.Error(w, http.StatusText(code), code)
+		}
+		return
+	}
+
+	contentType, err := fsv.contentType(name, rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	header.Set("Accept-Ranges", "bytes")
+	if rep.Encoding != "" {
+		header.Set("Content-Encoding", rep.Encoding)
+	}
+
+	var parts []*Part
+	if rangeApplies(r, rep.ETag(), rep.ModTime) {
+		// invalid headers and ranges of empty files are ignored, ranges of changed files too
+		if parts, err = ParseRangeLenient(r.Header.Get("Range"), contentType, rep.Size); err != nil {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", rep.Size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	serveParts(w, r, rep.File, rep.Size, contentType, parts)
+}
+
+// representation opens name or one of its siblings, fs.ErrInvalid is returned for directories.
+func (fsv *FileServer) representation(name, acceptEncoding string) (*Representation, error) {
+	return SelectRepresentation(fsv.openSeekable, name, acceptEncoding, fsv.siblings)
+}
+
+func (fsv *FileServer) openSeekable(name string) (ReadSeekCloser, error) {
+	file, err := fsv.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if info.IsDir() {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	} else if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	seekable, ok := file.(ReadSeekCloser)
+	if !ok {
+		file.Close()
+		return nil, &fs.PathError{Op: "seek", Path: name, Err: errNotSeekable}
+	}
+	return seekable, nil
+}
+
+// contentType detects the content type of name. The bytes of an encoded representation are compressed,
+// so the identity file is sniffed instead, and application/octet-stream is used if it doesn't exist.
+func (fsv *FileServer) contentType(name string, rep *Representation) (string, error) {
+	if rep.Encoding == "" {
+		return fileContentType(name, rep.File)
+	} else if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	identity, err := fsv.openSeekable(name)
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+	defer identity.Close()
+	return fileContentType(name, identity)
+}
+
+// serveWhole serves a file which is not seekable without ranges and precompressed siblings.
+func (fsv *FileServer) serveWhole(w http.ResponseWriter, r *http.Request, name string) {
+	file, err := fsv.fsys.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	etag := (&Representation{Size: info.Size(), ModTime: info.ModTime()}).ETag()
+	setValidators(header, etag, info.ModTime())
+	header.Set("Accept-Ranges", "none")
+	if code := checkPreconditions(r, etag, info.ModTime()); code != 0 {
+		if code == http.StatusNotModified {
+			w.WriteHeader(code)
+		} else {
+			http.Error(w, http.StatusText(code), code)
+		}
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		if _, err = io.CopyN(w, file, info.Size()); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// cleanPath turns a URL path into a name of fs.FS, ok is false if it can not be a valid name.
+func cleanPath(urlPath string) (string, bool) {
+	if strings.ContainsAny(urlPath, "\\\x00") {
+		return "", false
+	}
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+// fileContentType detects the content type by the extension of name or the first 512 bytes of file.
+func fileContentType(name string, file io.ReadSeeker) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	var buf [512]byte
+	n, err := io.ReadFull(file, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// setValidators sets ETag and Last-Modified, neither is set if the modification time is unknown.
+func setValidators(header http.Header, etag string, modTime time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// checkPreconditions evaluates conditional headers in the order of RFC 7232 section 6,
+// it returns 0 if the request should be served.
+func checkPreconditions(r *http.Request, etag string, modTime time.Time) int {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatch(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !modTime.IsZero() {
+		if modTime.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatch(ifNoneMatch, etag, true) {
+			return http.StatusNotModified
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		if !modTime.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// rangeApplies evaluates If-Range, a Range header is ignored if the representation has changed.
+func rangeApplies(r *http.Request, etag string, modTime time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	} else if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// only strong ETags match
+		return etag != "" && ifRange == etag
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(since)
+}
+
+// etagListMatch reports whether etag is in the list of an If-Match or If-None-Match header,
+// only "*" matches if etag is empty.
+func etagListMatch(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if etag != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
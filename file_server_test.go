@@ -0,0 +1,467 @@
+package multipart
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// streamFS hides Seek of the files in an fs.FS.
+type streamFS struct {
+	fs.FS
+}
+
+type streamFile struct {
+	file fs.File
+}
+
+func (sf *streamFile) Stat() (fs.FileInfo, error) { return sf.file.Stat() }
+func (sf *streamFile) Read(p []byte) (int, error) { return sf.file.Read(p) }
+func (sf *streamFile) Close() error               { return sf.file.Close() }
+
+func (sfs streamFS) Open(name string) (fs.File, error) {
+	file, err := sfs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &streamFile{file: file}, nil
+}
+
+// failingFS serves files whose reads fail, their Stat and Seek still work.
+type failingFS struct {
+	fs.FS
+}
+
+type failingFile struct {
+	fs.File
+	io.Seeker
+}
+
+func (ff *failingFile) Read(p []byte) (int, error) {
+	return 0, errors.New("disk is broken")
+}
+
+func (ffs failingFS) Open(name string) (fs.File, error) {
+	file, err := ffs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: file, Seeker: file.(io.Seeker)}, nil
+}
+
+func serveFile(fsv *FileServer, method, target string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	fsv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestFileServer(t *testing.T) {
+	modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	content := "0123456789abcdefghij"
+	fsys := fstest.MapFS{
+		"a.txt":          &fstest.MapFile{Data: []byte(content), ModTime: modTime},
+		"a.txt.gz":       &fstest.MapFile{Data: []byte("gzipped"), ModTime: modTime},
+		"noext":          &fstest.MapFile{Data: []byte("<html><body>x</body></html>"), ModTime: modTime},
+		"empty.txt":      &fstest.MapFile{Data: []byte{}, ModTime: modTime},
+		"dir/index.html": &fstest.MapFile{Data: []byte("<p>index</p>"), ModTime: modTime},
+		"other/file.txt": &fstest.MapFile{Data: []byte("other"), ModTime: modTime},
+	}
+	gzipped := new(bytes.Buffer)
+	zw := gzip.NewWriter(gzipped)
+	zw.Write([]byte("<html><body>x</body></html>"))
+	zw.Close()
+	fsys["noext.gz"] = &fstest.MapFile{Data: gzipped.Bytes(), ModTime: modTime}
+	fsys["onlygz.gz"] = &fstest.MapFile{Data: gzipped.Bytes(), ModTime: modTime}
+	etag := (&Representation{Size: int64(len(content)), ModTime: modTime}).ETag()
+	lastModified := modTime.Format(http.TimeFormat)
+
+	t.Run("responses", func(t *testing.T) {
+		type testCase struct {
+			method        string
+			target        string
+			headers       map[string]string
+			expectStatus  int
+			expectBody    string
+			expectHeaders map[string]string
+		}
+		testCases := []*testCase{
+			&testCase{
+				method: "GET", target: "/a.txt", expectStatus: 200, expectBody: content,
+				expectHeaders: map[string]string{
+					"Content-Type":   "text/plain; charset=utf-8",
+					"Content-Length": "20",
+					"Accept-Ranges":  "bytes",
+					"ETag":           etag,
+					"Last-Modified":  lastModified,
+				},
+			},
+			&testCase{
+				method: "HEAD", target: "/a.txt", expectStatus: 200, expectBody: "",
+				expectHeaders: map[string]string{"Content-Length": "20", "ETag": etag},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=2-5"},
+				expectStatus: 206, expectBody: "2345",
+				expectHeaders: map[string]string{"Content-Range": "bytes 2-5/20", "Content-Length": "4"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=-3"},
+				expectStatus: 206, expectBody: "hij",
+				expectHeaders: map[string]string{"Content-Range": "bytes 17-19/20"},
+			},
+			&testCase{
+				method: "HEAD", target: "/a.txt", headers: map[string]string{"Range": "bytes=2-5"},
+				expectStatus: 206, expectBody: "",
+				expectHeaders: map[string]string{"Content-Range": "bytes 2-5/20", "Content-Length": "4"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=30-"},
+				expectStatus: 416, expectHeaders: map[string]string{"Content-Range": "bytes */20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=30-, 40-50"},
+				expectStatus: 416, expectHeaders: map[string]string{"Content-Range": "bytes */20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=-0"},
+				expectStatus: 416,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=99999999999999999999-"},
+				expectStatus: 416,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-999"},
+				expectStatus: 206, expectBody: content,
+				expectHeaders: map[string]string{"Content-Range": "bytes 0-19/20", "Content-Length": "20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=15-99999999999999999999"},
+				expectStatus: 206, expectBody: "fghij",
+				expectHeaders: map[string]string{"Content-Range": "bytes 15-19/20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=-20"},
+				expectStatus: 206, expectBody: content,
+				expectHeaders: map[string]string{"Content-Range": "bytes 0-19/20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=-50"},
+				expectStatus: 206, expectBody: content,
+				expectHeaders: map[string]string{"Content-Range": "bytes 0-19/20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=30-, 2-3"},
+				expectStatus: 206, expectBody: "23",
+				expectHeaders: map[string]string{"Content-Range": "bytes 2-3/20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=5-2"},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=abc"},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-1, x-"},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes="},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-,0-,0-,0-,0-"},
+				expectStatus: 206, expectBody: content,
+				expectHeaders: map[string]string{"Content-Range": "bytes 0-19/20", "Content-Length": "20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=4-9, 0-5, 10-11"},
+				expectStatus: 206, expectBody: "0123456789ab",
+				expectHeaders: map[string]string{"Content-Range": "bytes 0-11/20"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "items=0-1"},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/empty.txt", headers: map[string]string{"Range": "bytes=0-1"},
+				expectStatus: 200, expectBody: "", expectHeaders: map[string]string{"Content-Length": "0"},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-1", "If-Range": etag},
+				expectStatus: 206, expectBody: "01",
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"Range": "bytes=0-1", "If-Range": lastModified},
+				expectStatus: 206, expectBody: "01",
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-None-Match": etag},
+				expectStatus: 304, expectBody: "", expectHeaders: map[string]string{"ETag": etag},
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-None-Match": `"x", W/` + etag},
+				expectStatus: 304, expectBody: "",
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-Modified-Since": lastModified},
+				expectStatus: 304, expectBody: "",
+			},
+			&testCase{
+				method: "GET", target: "/a.txt",
+				headers:      map[string]string{"If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-Match": `"other"`},
+				expectStatus: 412,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-Match": "W/" + etag},
+				expectStatus: 412,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt", headers: map[string]string{"If-Match": "*"},
+				expectStatus: 200, expectBody: content,
+			},
+			&testCase{
+				method: "GET", target: "/a.txt",
+				headers:      map[string]string{"If-Unmodified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)},
+				expectStatus: 412,
+			},
+			&testCase{
+				method: "GET", target: "/noext", expectStatus: 200, expectBody: "<html><body>x</body></html>",
+				expectHeaders: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+			},
+			&testCase{
+				method: "GET", target: "/dir/", expectStatus: 200, expectBody: "<p>index</p>",
+				expectHeaders: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+			},
+			&testCase{method: "GET", target: "/other", expectStatus: 404},
+			&testCase{method: "GET", target: "/missing.txt", expectStatus: 404},
+			&testCase{method: "GET", target: "/../../etc/passwd", expectStatus: 404},
+			&testCase{method: "GET", target: "/dir/..%5Ca.txt", expectStatus: 400},
+			&testCase{
+				method: "POST", target: "/a.txt", expectStatus: 405,
+				expectHeaders: map[string]string{"Allow": "GET, HEAD"},
+			},
+		}
+
+		fsv := NewFileServer(fsys)
+		for _, tc := range testCases {
+			rec := serveFile(fsv, tc.method, tc.target, tc.headers)
+			if rec.Code != tc.expectStatus {
+				t.Errorf("%s %s %v: expect status(%d) got(%d)", tc.method, tc.target, tc.headers, tc.expectStatus, rec.Code)
+				continue
+			}
+			if tc.expectStatus < 300 || tc.expectStatus == 304 {
+				if body := rec.Body.String(); body != tc.expectBody {
+					t.Errorf("%s %s %v: expect body(%q) got(%q)", tc.method, tc.target, tc.headers, tc.expectBody, body)
+				}
+			}
+			for key, value := range tc.expectHeaders {
+				if got := rec.Header().Get(key); got != value {
+					t.Errorf("%s %s %v: expect %s(%q) got(%q)", tc.method, tc.target, tc.headers, key, value, got)
+				}
+			}
+		}
+	})
+
+	t.Run("multiple ranges", func(t *testing.T) {
+		fsv := NewFileServer(fsys)
+		rec := serveFile(fsv, "GET", "/a.txt", map[string]string{"Range": "bytes=0-1, 10-12"})
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("expect status(206) got(%d)", rec.Code)
+		}
+		if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+			t.Fatalf("content length(%s) doesn't match body(%d)", rec.Header().Get("Content-Length"), rec.Body.Len())
+		}
+
+		mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("unexpected content type %q %v", rec.Header().Get("Content-Type"), err)
+		}
+		mr := multipart.NewReader(rec.Body, params["boundary"])
+		expects := []string{"bytes 0-1/20:01", "bytes 10-12/20:abc"}
+		for i, expect := range expects {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.Header.Get("Content-Range") + ":" + string(body); got != expect {
+				t.Errorf("part %d: expect(%s) got(%s)", i, expect, got)
+			}
+		}
+		if _, err = mr.NextPart(); err != io.EOF {
+			t.Errorf("expect EOF got(%v)", err)
+		}
+
+		head := serveFile(fsv, "HEAD", "/a.txt", map[string]string{"Range": "bytes=0-1, 10-12"})
+		if head.Code != http.StatusPartialContent || head.Body.Len() != 0 || head.Header().Get("Content-Length") != rec.Header().Get("Content-Length") {
+			t.Errorf("unexpected HEAD response %d %q %q", head.Code, head.Header().Get("Content-Length"), head.Body.String())
+		}
+	})
+
+	t.Run("precompressed", func(t *testing.T) {
+		fsv := NewFileServer(fsys)
+		fsv.SetPrecompressed(nil)
+
+		rec := serveFile(fsv, "GET", "/a.txt", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-2"})
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != "gzi" {
+			t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("expect Content-Encoding(gzip) got(%q)", got)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("expect the content type of the identity got(%q)", got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("expect Vary(Accept-Encoding) got(%q)", got)
+		}
+		if got := rec.Header().Get("ETag"); got == etag {
+			t.Errorf("ETag of the encoded representation equals to the identity's")
+		}
+
+		// files without an extension are sniffed from the identity, not from the compressed bytes
+		for target, expect := range map[string]string{"/noext": "text/html; charset=utf-8", "/onlygz": "application/octet-stream"} {
+			rec = serveFile(fsv, "GET", target, map[string]string{"Accept-Encoding": "gzip"})
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("%s: unexpected response %d %q", target, rec.Code, rec.Header().Get("Content-Encoding"))
+			} else if got := rec.Header().Get("Content-Type"); got != expect {
+				t.Errorf("%s: expect Content-Type(%s) got(%s)", target, expect, got)
+			}
+		}
+
+		rec = serveFile(fsv, "GET", "/a.txt", map[string]string{"Accept-Encoding": "identity;q=0"})
+		if rec.Code != http.StatusNotAcceptable {
+			t.Errorf("expect status(406) got(%d)", rec.Code)
+		}
+	})
+
+	t.Run("not seekable", func(t *testing.T) {
+		fsv := NewFileServer(streamFS{fsys})
+
+		rec := serveFile(fsv, "GET", "/a.txt", map[string]string{"Range": "bytes=0-1"})
+		if rec.Code != http.StatusOK || rec.Body.String() != content {
+			t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Accept-Ranges"); got != "none" {
+			t.Errorf("expect Accept-Ranges(none) got(%q)", got)
+		}
+		if got := rec.Header().Get("ETag"); got != etag {
+			t.Errorf("expect ETag(%s) got(%s)", etag, got)
+		}
+
+		rec = serveFile(fsv, "GET", "/a.txt", map[string]string{"If-None-Match": etag})
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("expect status(304) got(%d)", rec.Code)
+		}
+		rec = serveFile(fsv, "HEAD", "/dir/", nil)
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "12" {
+			t.Errorf("unexpected HEAD response %d %q", rec.Code, rec.Header().Get("Content-Length"))
+		}
+	})
+
+	t.Run("serving error aborts response", func(t *testing.T) {
+		for _, fsv := range []*FileServer{NewFileServer(failingFS{fsys}), NewFileServer(streamFS{failingFS{fsys}})} {
+			for _, rangeValue := range []string{"", "bytes=0-1", "bytes=0-1, 5-6"} {
+				aborted := func() (aborted bool) {
+					defer func() {
+						aborted = recover() == http.ErrAbortHandler
+					}()
+					serveFile(fsv, "GET", "/a.txt", map[string]string{"Range": rangeValue})
+					return false
+				}()
+				if !aborted {
+					t.Errorf("%T %q: expect the response to be aborted", fsv.fsys, rangeValue)
+				}
+			}
+		}
+	})
+
+	t.Run("unknown modification time", func(t *testing.T) {
+		// files of embed.FS have no modification time, so the size alone would be their ETag
+		fsv := NewFileServer(fstest.MapFS{"embedded.txt": &fstest.MapFile{Data: []byte(content)}})
+
+		rec := serveFile(fsv, "GET", "/embedded.txt", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != content {
+			t.Fatalf("unexpected response %d %q", rec.Code, rec.Body.String())
+		}
+		for _, key := range []string{"ETag", "Last-Modified"} {
+			if got := rec.Header().Get(key); got != "" {
+				t.Errorf("expect no %s got(%q)", key, got)
+			}
+		}
+
+		for _, headers := range []map[string]string{
+			{"If-None-Match": `"0-14"`},
+			{"If-None-Match": `"x", , "y"`},
+			{"If-Modified-Since": modTime.Format(http.TimeFormat)},
+			{"Range": "bytes=0-1", "If-Range": `"0-14"`},
+			{"Range": "bytes=0-1", "If-Range": modTime.Format(http.TimeFormat)},
+		} {
+			rec = serveFile(fsv, "GET", "/embedded.txt", headers)
+			if rec.Code != http.StatusOK || rec.Body.String() != content {
+				t.Errorf("%v: expect the whole file got(%d %q)", headers, rec.Code, rec.Body.String())
+			}
+		}
+		if rec = serveFile(fsv, "GET", "/embedded.txt", map[string]string{"If-Match": `"0-14"`}); rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("expect status(412) got(%d)", rec.Code)
+		}
+
+		rec = serveFile(NewFileServer(streamFS{fsv.fsys}), "GET", "/embedded.txt", nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+			t.Errorf("unexpected response %d ETag(%q)", rec.Code, rec.Header().Get("ETag"))
+		}
+	})
+
+	t.Run("os dir", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "file_server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err = os.WriteFile(filepath.Join(dir, "data.bin"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		fsv := NewFileServer(os.DirFS(dir))
+		rec := serveFile(fsv, "GET", "/data.bin", map[string]string{"Range": "bytes=5-9,-2"})
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("expect status(206) got(%d)", rec.Code)
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, "Content-Range: bytes 5-9/20\r\n\r\n56789") ||
+			!strings.Contains(body, "Content-Range: bytes 18-19/20\r\n\r\nij") {
+			t.Errorf("unexpected body %q", body)
+		}
+	})
+}
@@ -0,0 +1,417 @@
+package multipart
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// deflateWindowSize is the longest distance a deflate stream can refer back to.
+const deflateWindowSize = 1 << 15
+
+var errCorruptDeflate = errors.New("corrupt deflate stream")
+
+var (
+	deflateLengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	deflateLengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	deflateDistBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	deflateDistExtra   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	codeLengthOrder    = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// bitReader reads a deflate stream from its least significant bits without reading ahead,
+// so the position of every bit is known.
+type bitReader struct {
+	r     io.ByteReader
+	off   int64 // bytes read from r
+	bits  uint32
+	nbits uint
+	eof   bool
+}
+
+// fill reads bytes until n bits are buffered, it stops early at the end of the stream.
+func (br *bitReader) fill(n uint) error {
+	for br.nbits < n && !br.eof {
+		c, err := br.r.ReadByte()
+		if err == io.EOF {
+			br.eof = true
+			break
+		} else if err != nil {
+			return err
+		}
+		br.off++
+		br.bits |= uint32(c) << br.nbits
+		br.nbits += 8
+	}
+	return nil
+}
+
+func (br *bitReader) readBits(n uint) (int, error) {
+	if err := br.fill(n); err != nil {
+		return 0, err
+	} else if br.nbits < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := br.bits & (1<<n - 1)
+	br.bits >>= n
+	br.nbits -= n
+	return int(v), nil
+}
+
+// alignByte drops the rest of the current byte.
+func (br *bitReader) alignByte() {
+	br.bits >>= br.nbits % 8
+	br.nbits -= br.nbits % 8
+}
+
+// bitOffset returns the position of the next bit from the start of r.
+func (br *bitReader) bitOffset() int64 {
+	return br.off*8 - int64(br.nbits)
+}
+
+// huffman decodes canonical Huffman codes with a table indexed by the next maxLen bits.
+type huffman struct {
+	maxLen uint
+	table  []uint16 // symbol<<4 | code length, 0 if no code matches
+}
+
+func newHuffman(lengths []int) (*huffman, error) {
+	var count [16]int
+	maxLen := 0
+	for _, l := range lengths {
+		count[l]++
+		if l > maxLen {
+			maxLen = l
+		}
+	}
+	if maxLen == 0 {
+		return &huffman{}, nil
+	}
+	left := 1
+	for l := 1; l < 16; l++ {
+		if left = left<<1 - count[l]; left < 0 {
+			return nil, errCorruptDeflate // over-subscribed
+		}
+	}
+
+	// the first code of each length, see RFC 1951 section 3.2.2
+	var next [16]int
+	count[0] = 0
+	for l, code := 1, 0; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	h := &huffman{maxLen: uint(maxLen), table: make([]uint16, 1<<uint(maxLen))}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		// codes are packed from their most significant bit
+		reversed := int(bits.Reverse16(uint16(next[l])) >> uint(16-l))
+		next[l]++
+		for i := reversed; i < len(h.table); i += 1 << uint(l) {
+			h.table[i] = uint16(sym<<4 | l)
+		}
+	}
+	return h, nil
+}
+
+func (br *bitReader) decode(h *huffman) (int, error) {
+	if err := br.fill(h.maxLen); err != nil {
+		return 0, err
+	}
+	if h.maxLen == 0 {
+		return 0, errCorruptDeflate
+	}
+	entry := h.table[br.bits&(1<<h.maxLen-1)]
+	l := uint(entry & 15)
+	if l == 0 {
+		return 0, errCorruptDeflate
+	} else if l > br.nbits {
+		return 0, io.ErrUnexpectedEOF
+	}
+	br.bits >>= l
+	br.nbits -= l
+	return int(entry >> 4), nil
+}
+
+var fixedLiteral, fixedDistance = func() (*huffman, *huffman) {
+	lengths := make([]int, 288)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit, _ := newHuffman(lengths)
+	dist, _ := newHuffman([]int{5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5})
+	return lit, dist
+}()
+
+// inflater decompresses a raw deflate stream, it can start at a block boundary in the middle of a stream
+// with the window before it, and reports every block boundary so a checkpoint can be taken there.
+type inflater struct {
+	br       bitReader
+	hist     [deflateWindowSize]byte // ring buffer of the latest output
+	hpos     int
+	hlen     int   // valid bytes in hist
+	total    int64 // bytes of output
+	final    bool
+	inBlock  bool
+	stored   int // remaining bytes of a stored block, -1 if the block is compressed
+	lit      *huffman
+	dist     *huffman
+	copyLen  int
+	copyDist int
+	err      error
+	// onBlock is called before the header of every block is read,
+	// bitOffset is the position of the block from the start of the stream.
+	onBlock func(bitOffset int64)
+}
+
+// newInflater starts decompressing r after skipping skipBits bits, window is the output before that position.
+func newInflater(r io.ByteReader, skipBits uint, window []byte) (*inflater, error) {
+	if len(window) > deflateWindowSize {
+		return nil, errors.New("window is too large")
+	}
+	inf := &inflater{br: bitReader{r: r}, stored: -1}
+	if _, err := inf.br.readBits(skipBits); err != nil {
+		return nil, err
+	}
+	inf.hlen = copy(inf.hist[:], window)
+	inf.hpos = inf.hlen % deflateWindowSize
+	return inf, nil
+}
+
+// window returns a copy of the last bytes of the output which later blocks may refer to.
+func (inf *inflater) window() []byte {
+	window := make([]byte, 0, inf.hlen)
+	if inf.hlen == deflateWindowSize {
+		window = append(window, inf.hist[inf.hpos:]...)
+	}
+	return append(window, inf.hist[:inf.hpos]...)
+}
+
+func (inf *inflater) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && inf.err == nil {
+		if inf.copyLen > 0 {
+			for ; inf.copyLen > 0 && n < len(p); inf.copyLen-- {
+				c := inf.hist[(inf.hpos-inf.copyDist+deflateWindowSize)%deflateWindowSize]
+				p[n] = c
+				n++
+				inf.emit(c)
+			}
+			continue
+		}
+
+		switch {
+		case !inf.inBlock:
+			if inf.final {
+				inf.err = io.EOF
+			} else {
+				inf.err = inf.readBlockHeader()
+			}
+		case inf.stored == 0:
+			inf.inBlock = false
+		case inf.stored > 0:
+			var c int
+			if c, inf.err = inf.br.readBits(8); inf.err == nil {
+				p[n] = byte(c)
+				n++
+				inf.emit(byte(c))
+				inf.stored--
+			}
+		default:
+			inf.err = inf.readSymbol(p, &n)
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, inf.err
+}
+
+// readTrailer reads the bytes after the final block, e.g. the gzip trailer. The bit reader reads at most
+// 2 bytes ahead of the end of the stream, so no byte after p is buffered if p is longer than 2 bytes.
+func (inf *inflater) readTrailer(p []byte) error {
+	inf.br.alignByte()
+	for i := range p {
+		c, err := inf.br.readBits(8)
+		if err != nil {
+			return err
+		}
+		p[i] = byte(c)
+	}
+	return nil
+}
+
+func (inf *inflater) emit(c byte) {
+	inf.hist[inf.hpos] = c
+	inf.hpos = (inf.hpos + 1) % deflateWindowSize
+	inf.total++
+	if inf.hlen < deflateWindowSize {
+		inf.hlen++
+	}
+}
+
+func (inf *inflater) readBlockHeader() error {
+	if inf.onBlock != nil {
+		inf.onBlock(inf.br.bitOffset())
+	}
+	header, err := inf.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	inf.final = header&1 == 1
+	inf.inBlock = true
+	inf.stored = -1
+
+	switch header >> 1 {
+	case 0:
+		inf.br.alignByte()
+		length, err := inf.br.readBits(16)
+		if err != nil {
+			return err
+		}
+		nlength, err := inf.br.readBits(16)
+		if err != nil {
+			return err
+		} else if length != ^nlength&0xffff {
+			return errCorruptDeflate
+		}
+		inf.stored = length
+	case 1:
+		inf.lit, inf.dist = fixedLiteral, fixedDistance
+	case 2:
+		return inf.readDynamicTables()
+	default:
+		return errCorruptDeflate
+	}
+	return nil
+}
+
+func (inf *inflater) readDynamicTables() error {
+	var counts [3]int
+	for i, n := range []uint{5, 5, 4} {
+		v, err := inf.br.readBits(n)
+		if err != nil {
+			return err
+		}
+		counts[i] = v
+	}
+	nlit, ndist, nclen := counts[0]+257, counts[1]+1, counts[2]+4
+	if nlit > 286 || ndist > 30 {
+		return errCorruptDeflate
+	}
+
+	clLengths := make([]int, 19)
+	for i := 0; i < nclen; i++ {
+		v, err := inf.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		clLengths[codeLengthOrder[i]] = v
+	}
+	cl, err := newHuffman(clLengths)
+	if err != nil {
+		return err
+	}
+
+	lengths := make([]int, nlit+ndist)
+	for i := 0; i < len(lengths); {
+		sym, err := inf.br.decode(cl)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = sym
+			i++
+			continue
+		}
+
+		repeat, value := 0, 0
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			value = lengths[i-1]
+			repeat, err = inf.br.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = inf.br.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = inf.br.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		} else if i+repeat > len(lengths) {
+			return errCorruptDeflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorruptDeflate // no end of block
+	}
+
+	if inf.lit, err = newHuffman(lengths[:nlit]); err != nil {
+		return err
+	}
+	inf.dist, err = newHuffman(lengths[nlit:])
+	return err
+}
+
+// readSymbol decodes a literal into p, the end of the block or a back reference.
+func (inf *inflater) readSymbol(p []byte, n *int) error {
+	sym, err := inf.br.decode(inf.lit)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sym < 256:
+		p[*n] = byte(sym)
+		*n++
+		inf.emit(byte(sym))
+		return nil
+	case sym == 256:
+		inf.inBlock = false
+		return nil
+	case sym > 285:
+		return errCorruptDeflate
+	}
+
+	extra, err := inf.br.readBits(deflateLengthExtra[sym-257])
+	if err != nil {
+		return err
+	}
+	length := deflateLengthBase[sym-257] + extra
+
+	sym, err = inf.br.decode(inf.dist)
+	if err != nil {
+		return err
+	} else if sym >= 30 {
+		return errCorruptDeflate
+	}
+	if extra, err = inf.br.readBits(deflateDistExtra[sym]); err != nil {
+		return err
+	}
+	dist := deflateDistBase[sym] + extra
+	if dist > inf.hlen {
+		return errCorruptDeflate // refers to bytes before the window
+	}
+	inf.copyLen, inf.copyDist = length, dist
+	return nil
+}
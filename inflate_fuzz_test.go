@@ -0,0 +1,39 @@
+package multipart
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+)
+
+func FuzzInflater(f *testing.F) {
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly} {
+		buf := new(bytes.Buffer)
+		fw, _ := flate.NewWriter(buf, level)
+		fw.Write(bytes.Repeat([]byte("GET /objects/0123 200\n"), 50))
+		fw.Close()
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x03, 0x00})
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		// streams expanding to more than 1 MiB are compared by their first 1 MiB
+		const limit = 1 << 20
+		inf, err := newInflater(bytes.NewReader(stream), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(io.LimitReader(inf, limit))
+
+		expect, expectErr := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(stream)), limit))
+		if expectErr != nil {
+			return
+		} else if err != nil {
+			t.Fatalf("valid stream fails: %s", err)
+		} else if !bytes.Equal(out, expect) {
+			t.Fatalf("expect %d bytes got %d bytes", len(expect), len(out))
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package multipart
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestInflater(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := new(bytes.Buffer)
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(text, "%d GET /objects/%x %d\n", i, rnd.Int63(), rnd.Intn(1000))
+	}
+	random := make([]byte, 100000)
+	rnd.Read(random)
+
+	compress := func(content []byte, level int) []byte {
+		buf := new(bytes.Buffer)
+		fw, err := flate.NewWriter(buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write(content); err != nil {
+			t.Fatal(err)
+		} else if err = fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	type boundary struct {
+		bitOffset int64
+		outOffset int64
+		window    []byte
+	}
+
+	for _, content := range [][]byte{text.Bytes(), random, []byte("a"), {}} {
+		for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression, flate.HuffmanOnly} {
+			compressed := compress(content, level)
+
+			inf, err := newInflater(bufio.NewReader(bytes.NewReader(compressed)), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var boundaries []boundary
+			out := new(bytes.Buffer)
+			inf.onBlock = func(bitOffset int64) {
+				boundaries = append(boundaries, boundary{bitOffset: bitOffset, outOffset: inf.total, window: inf.window()})
+			}
+			buf := make([]byte, 7)
+			for {
+				n, err := inf.Read(buf)
+				out.Write(buf[:n])
+				if err != nil {
+					break
+				}
+			}
+			if !bytes.Equal(out.Bytes(), content) {
+				t.Fatalf("level(%d): output of %d bytes is not equal to the content of %d bytes", level, out.Len(), len(content))
+			}
+
+			// decompression resumes at every block boundary with its window
+			for _, b := range boundaries {
+				r := bufio.NewReader(bytes.NewReader(compressed[b.bitOffset/8:]))
+				resumed, err := newInflater(r, uint(b.bitOffset%8), b.window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rest, err := io.ReadAll(resumed)
+				if err != nil {
+					t.Fatal(err)
+				} else if !bytes.Equal(rest, content[b.outOffset:]) {
+					t.Errorf("level(%d): resuming at bit %d is not equal to the content", level, b.bitOffset)
+				}
+			}
+		}
+	}
+
+	t.Run("corrupt streams", func(t *testing.T) {
+		compressed := compress(text.Bytes(), flate.DefaultCompression)
+		for _, corrupt := range [][]byte{
+			compressed[:len(compressed)/2],
+			{0x07},       // reserved block type
+			{0x01, 0, 0}, // stored block whose length doesn't match
+		} {
+			inf, err := newInflater(bytes.NewReader(corrupt), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadAll(inf); err == nil {
+				t.Errorf("%x: corrupt stream should fail", corrupt)
+			}
+		}
+
+		// the second block refers to the output before it
+		var offsets []int64
+		inf, err := newInflater(bytes.NewReader(compressed), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inf.onBlock = func(bitOffset int64) {
+			offsets = append(offsets, bitOffset)
+		}
+		if _, err = io.ReadAll(inf); err != nil || len(offsets) < 3 {
+			t.Fatalf("unexpected blocks at %v %v", offsets, err)
+		}
+		second := offsets[1]
+		inf, err = newInflater(bytes.NewReader(compressed[second/8:]), uint(second%8), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadAll(inf); err != errCorruptDeflate {
+			t.Errorf("resuming without the window should fail: %v", err)
+		}
+	})
+}
@@ -2,45 +2,114 @@ package multipart
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var ErrClosed = func(err error) error {
 	return fmt.Errorf("pipe is closed before writing %s", err)
 }
 
+// MultipartReader is an io.Reader of a range response, Start writes the response into a pipe read by Read.
+//
+// It also implements io.WriterTo, so io.Copy(w, mr) calls WriteTo: the response is written into w directly
+// and Start only waits for it, a Start in another goroutine is not needed and blocks until the copy is done.
+// Read can't be used at the same time because nothing is written into the pipe then.
 type MultipartReader struct {
-	src           ReadSeekCloser
+	src           RangeSource
+	ctx           context.Context
 	outputHeaders bool
 	contentLen    int64
+	contentType   string
+	disposition   string
+	encoding      string
+	varyEncoding  bool
+	lastModified  time.Time
+	headers       textproto.MIMEHeader
+	now           func() time.Time
 	parts         []*Part
 	boundary      string
 	w             *io.PipeWriter
 	r             *io.PipeReader
 	transformer   *Transformer
+	observer      Observer
+	preflight     bool
+	onTruncated   TruncationHandler
+	mu            sync.Mutex
+	started       bool
+	done          chan struct{}
+	err           error
 }
 
 func NewMultipartReader(src ReadSeekCloser, parts []*Part) (*MultipartReader, error) {
-	return NewMultipartReaderWithBoudary(src, parts, randomBoundary())
+	return NewMultipartReaderWithGenerator(src, parts, RandomBoundaryGenerator{})
+}
+
+// NewMultipartReaderFromRange parses the Range header with the size of src, see NewTransformerFromRange.
+func NewMultipartReaderFromRange(src ReadSeekCloser, rangeValue string) (*MultipartReader, error) {
+	size, err := sourceSize(src)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ParseRangeLenient(rangeValue, "", size)
+	if err != nil {
+		return nil, err
+	}
+	return NewMultipartReader(src, parts)
+}
+
+// NewMultipartReaderWithGenerator uses the boundary generated by gen.
+func NewMultipartReaderWithGenerator(src ReadSeekCloser, parts []*Part, gen BoundaryGenerator) (*MultipartReader, error) {
+	boundary, err := gen.Boundary(parts)
+	if err != nil {
+		return nil, err
+	}
+	return NewMultipartReaderWithBoudary(src, parts, boundary)
 }
 
 func NewMultipartReaderWithBoudary(src ReadSeekCloser, parts []*Part, boundary string) (*MultipartReader, error) {
+	return NewMultipartReaderWithSource(NewReadSeekerSource(src), parts, boundary)
+}
+
+// NewMultipartReaderWithSource creates a reader which streams parts from a RangeSource.
+func NewMultipartReaderWithSource(src RangeSource, parts []*Part, boundary string) (*MultipartReader, error) {
+	transformer, err := NewTransformerWithSource(src, parts, boundary)
+	if err != nil {
+		return nil, err
+	}
+
 	r, w := io.Pipe()
 	mpReader := &MultipartReader{
 		src:         src,
+		ctx:         context.Background(),
 		parts:       parts,
 		boundary:    boundary,
 		w:           w,
 		r:           r,
-		transformer: NewTransformerWithBoundary(src, parts, boundary),
+		transformer: transformer,
+		contentType: "application/octet-stream",
+		headers:     textproto.MIMEHeader{},
+		now:         time.Now,
+		observer:    NopObserver{},
+		done:        make(chan struct{}),
 	}
 
 	switch len(parts) {
 	case 0:
-		return nil, errors.New("no part to write")
+		// no range is requested, the whole source is written as a 200 response
+		// the plan is created now so the length of the body is fixed
+		plan, err := transformer.Plan()
+		if err != nil {
+			return nil, err
+		}
+		mpReader.contentLen = plan.Length()
 	case 1:
 		// rw.reader, rw.pw = io.Pipe()
 		mpReader.contentLen = int64(parts[0].rangeEndInt - parts[0].rangeStartInt + 1)
@@ -56,67 +125,270 @@ func (mr *MultipartReader) ContentLength() int64 {
 	return mr.contentLen
 }
 
+// StatusCode returns 200 if the whole source is written, or 206 otherwise.
+func (mr *MultipartReader) StatusCode() int {
+	if len(mr.parts) == 0 {
+		return 200
+	}
+	return 206
+}
+
+// SetContentType sets the content type of the response when the whole source is written.
+func (mr *MultipartReader) SetContentType(contentType string) error {
+	if err := validateMediaType(contentType); err != nil {
+		return err
+	}
+	mr.contentType = contentType
+	return nil
+}
+
+// SetContentDisposition adds a Content-Disposition header to the response, see FormatContentDisposition.
+func (mr *MultipartReader) SetContentDisposition(disposition, fileName string) error {
+	value, err := FormatContentDisposition(disposition, fileName)
+	if err != nil {
+		return err
+	}
+	mr.disposition = value
+	return nil
+}
+
+// SetContentEncoding sets the content coding of the source, e.g. "gzip" if the source is a .gz file,
+// Content-Range and Content-Length then refer to the encoded bytes.
+func (mr *MultipartReader) SetContentEncoding(encoding string) error {
+	if rest, ok := consumeToken(encoding); encoding != "" && (!ok || rest != "") {
+		return fmt.Errorf("invalid content encoding %q", encoding)
+	}
+	mr.encoding = encoding
+	return nil
+}
+
+// SetRepresentation describes the response with a representation selected by SelectRepresentation,
+// the reader should be created from rep.File. ETag and Last-Modified are set if they are not set yet and rep has them,
+// and Accept-Encoding is added to Vary because the representation depends on it.
+func (mr *MultipartReader) SetRepresentation(rep *Representation) error {
+	if err := mr.SetContentEncoding(rep.Encoding); err != nil {
+		return err
+	}
+	mr.varyEncoding = true
+	if etag := rep.ETag(); etag != "" && mr.headers.Get("ETag") == "" {
+		mr.headers.Set("ETag", etag)
+	}
+	if mr.lastModified.IsZero() {
+		mr.lastModified = rep.ModTime
+	}
+	return nil
+}
+
+func (mr *MultipartReader) SetLastModified(lastModified time.Time) {
+	mr.lastModified = lastModified
+}
+
+// SetHeader sets an extra response header, e.g. "Connection: close" or "ETag",
+// headers which describe the body are managed by the reader and can not be set.
+func (mr *MultipartReader) SetHeader(key, value string) error {
+	if err := validateHeader(key, value); err != nil {
+		return err
+	}
+
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	switch key {
+	case "Content-Length", "Content-Range", "Content-Type", "Content-Disposition", "Content-Encoding", "Transfer-Encoding":
+		return fmt.Errorf("header %s is managed by the reader", key)
+	}
+	mr.headers.Set(key, value)
+	return nil
+}
+
 func (mr *MultipartReader) SetOutputHeaders(val bool) {
 	mr.outputHeaders = val
 }
 
-func (mr *MultipartReader) Start() {
-	var err error
-	headerBuf := new(bytes.Buffer)
+func (mr *MultipartReader) SetObserver(observer Observer) {
+	mr.observer = observer
+	mr.transformer.SetObserver(observer)
+}
 
-	if len(mr.parts) == 1 {
-		if mr.outputHeaders {
-			if err := writeStatus(headerBuf, 206); err != nil {
-				mr.w.CloseWithError(err)
-			}
-
-			headers := textproto.MIMEHeader{}
-			headers.Add("Content-Range", fmt.Sprintf("bytes %s-%s/%s", mr.parts[0].rangeStart, mr.parts[0].rangeEnd, mr.parts[0].fileSize))
-			if err = writeHeaders(headerBuf, headers); err != nil {
-				mr.w.CloseWithError(err)
-			}
-		}
+// SetContext sets the context passed to RangeSource.OpenRange, writing stops once it is done.
+func (mr *MultipartReader) SetContext(ctx context.Context) {
+	mr.ctx = ctx
+	mr.transformer.SetContext(ctx)
+}
 
-		_, err = io.Copy(mr.w, headerBuf)
-		if err != nil {
-			mr.w.CloseWithError(err)
-			return
-		}
-		_, err = mr.w.Write([]byte("\r\n"))
+// SetPreflightCheck enables checking the size of the source before writing the response,
+// so a truncated source fails with a SourceTruncatedError before any byte is written.
+func (mr *MultipartReader) SetPreflightCheck(check bool) {
+	mr.preflight = check
+}
+
+// SetTruncationHandler sets the handler called when the source ends in the middle of a part,
+// see TruncationPolicy.
+func (mr *MultipartReader) SetTruncationHandler(handler TruncationHandler) {
+	mr.onTruncated = handler
+	mr.transformer.SetTruncationHandler(handler)
+}
+
+// VerifyBoundary makes sure the boundary doesn't appear in the parts, see Transformer.VerifyBoundary.
+// It should be called before ContentLength and Start because a new boundary may change them.
+func (mr *MultipartReader) VerifyBoundary(gen BoundaryGenerator, retries int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.started {
+		return errors.New("reader is started")
+	} else if len(mr.parts) < 2 {
+		return nil // no boundary is written
+	}
+
+	if err := mr.transformer.VerifyBoundary(gen, retries); err != nil {
+		return err
+	}
+	mr.boundary = mr.transformer.boundary
+	mr.contentLen = mr.transformer.ContentLength()
+	return nil
+}
+
+// Start writes the response into the pipe and stops at the first error,
+// the error is also returned by Read and Err.
+// If the response is being written by WriteTo, it waits until WriteTo is done.
+func (mr *MultipartReader) Start() error {
+	if !mr.claim() {
+		<-mr.done
+		return mr.Err()
+	}
+	_, err := mr.run(mr.w)
+	return err
+}
+
+// WriteTo writes the response into w directly without the pipe, so io.Copy(conn, mr)
+// can use sendfile/splice if the source is an *os.File, see Transformer.WriteTo.
+// If Start has been called, it copies the response from the pipe instead.
+func (mr *MultipartReader) WriteTo(w io.Writer) (int64, error) {
+	if !mr.claim() {
+		return io.Copy(w, mr.r)
+	}
+	return mr.run(w)
+}
+
+// claim returns true if the response is not being written by Start or WriteTo yet.
+func (mr *MultipartReader) claim() bool {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.started {
+		return false
+	}
+	mr.started = true
+	return true
+}
+
+func (mr *MultipartReader) run(w io.Writer) (int64, error) {
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	err := mr.write(cw)
+
+	mr.mu.Lock()
+	mr.err = err
+	mr.mu.Unlock()
+
+	// source file should be closed by user
+	if err != nil {
+		mr.observer.OnError(err)
+	} else {
+		mr.observer.OnComplete(cw.written, time.Since(start))
+	}
+	mr.w.CloseWithError(err)
+	close(mr.done)
+	return cw.written, err
+}
+
+// Err returns the error of Start or WriteTo, it is nil before the response is written.
+func (mr *MultipartReader) Err() error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.err
+}
+
+func (mr *MultipartReader) write(wt io.Writer) error {
+	if mr.preflight {
+		plan, err := mr.transformer.Plan()
 		if err != nil {
-			mr.w.CloseWithError(err)
-		}
-		if err = writePartBody(mr.src, mr.w, mr.parts[0]); err != nil {
-			mr.w.CloseWithError(err)
-			return
+			return err
+		} else if err = checkSourceSize(mr.src, plan.sourceParts()); err != nil {
+			return err
 		}
-	} else {
-		if mr.outputHeaders {
-			if err := writeStatus(headerBuf, 206); err != nil {
-				mr.w.CloseWithError(err)
-			}
-
-			headers := textproto.MIMEHeader{}
-			headers.Add("Content-Type", fmt.Sprintf("multipart/byteranges; boundary=%s", mr.boundary))
-			if err = writeHeaders(headerBuf, headers); err != nil {
-				mr.w.CloseWithError(err)
-			}
+	}
+
+	headerBuf := new(bytes.Buffer)
+	if mr.outputHeaders {
+		if err := writeStatus(headerBuf, mr.StatusCode()); err != nil {
+			return err
 		}
 
-		_, err = io.Copy(mr.w, headerBuf)
-		if err != nil {
-			mr.w.CloseWithError(err)
-			return
+		headers := mr.responseHeaders()
+		if err := writeHeaders(headerBuf, headers); err != nil {
+			return err
 		}
+	}
+
+	if _, err := io.Copy(wt, headerBuf); err != nil {
+		return err
+	}
+	if len(mr.parts) != 1 {
+		return mr.transformer.writeParts(wt, true)
+	}
 
-		if err = mr.transformer.WriteMultiParts(mr.w); err != nil {
-			mr.w.CloseWithError(err)
-			return
+	if _, err := wt.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	partStart := time.Now()
+	mr.observer.OnPartStart(0, mr.parts[0])
+	observeSeek(mr.observer, 0, mr.parts[0].rangeStartInt)
+	if err := copyRange(mr.ctx, mr.src, wt, mr.parts[0]); err != nil {
+		if err = handleTruncation(mr.onTruncated, wt, err); err != nil {
+			return err
 		}
 	}
+	mr.observer.OnPartDone(0, mr.parts[0], mr.parts[0].Len(), time.Since(partStart))
+	return nil
+}
 
-	// source file should be closed by user
-	mr.w.CloseWithError(nil) // TODO: log error
+// responseHeaders returns the headers written when outputHeaders is true.
+func (mr *MultipartReader) responseHeaders() textproto.MIMEHeader {
+	headers := textproto.MIMEHeader{}
+	for key, values := range mr.headers {
+		headers[key] = append([]string(nil), values...)
+	}
+	if headers.Get("Date") == "" {
+		headers.Set("Date", mr.now().UTC().Format(http.TimeFormat))
+	}
+	if !mr.lastModified.IsZero() {
+		headers.Set("Last-Modified", mr.lastModified.UTC().Format(http.TimeFormat))
+	}
+	if mr.disposition != "" {
+		headers.Set("Content-Disposition", mr.disposition)
+	}
+	if mr.encoding != "" {
+		headers.Set("Content-Encoding", mr.encoding)
+	}
+	if mr.varyEncoding {
+		addVary(headers, "Accept-Encoding")
+	}
+	headers.Set("Accept-Ranges", "bytes")
+	headers.Set("Content-Length", strconv.FormatInt(mr.ContentLength(), 10))
+
+	switch len(mr.parts) {
+	case 0:
+		headers.Set("Content-Type", mr.contentType)
+	case 1:
+		part := mr.parts[0]
+		if part.contentType != "" {
+			headers.Set("Content-Type", part.contentType)
+		} else {
+			headers.Set("Content-Type", mr.contentType)
+		}
+		headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", part.rangeStartInt, part.rangeEndInt, part.fileSize))
+	default:
+		headers.Set("Content-Type", multipartContentType(mr.boundary))
+	}
+	return headers
 }
 
 func (mr *MultipartReader) Read(p []byte) (n int, err error) {
@@ -1,17 +1,25 @@
 package multipart
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMultipartReader(t *testing.T) {
 	fileName := "download.jpg"
 	ctype := "application/pdf"
 	boundary := "BOUNDARY"
+	date := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
 
 	type testCase struct {
 		src       string
@@ -32,7 +40,10 @@ func TestMultipartReader(t *testing.T) {
 				fileSize: fmt.Sprintf("%d", len("10110")),
 				ranges:   "bytes=1-2, 3-3, -2, 2-",
 				expectOut: `HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Content-Length: 356
 Content-Type: multipart/byteranges; boundary=BOUNDARY
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 --BOUNDARY
 Content-Type: application/octet-stream
@@ -46,12 +57,12 @@ Content-Range: bytes 3-3/5
 1
 --BOUNDARY
 Content-Type: application/octet-stream
-Content-Range: bytes -2/5
+Content-Range: bytes 3-4/5
 
 10
 --BOUNDARY
 Content-Type: application/octet-stream
-Content-Range: bytes 2-/5
+Content-Range: bytes 2-4/5
 
 110
 --BOUNDARY--`,
@@ -64,7 +75,10 @@ Content-Range: bytes 2-/5
 				fileSize: "*",
 				ranges:   "bytes=0-1, 3-3",
 				expectOut: `HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Content-Length: 183
 Content-Type: multipart/byteranges; boundary=BOUNDARY
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 --BOUNDARY
 Content-Type: application/octet-stream
@@ -93,13 +107,14 @@ Content-Range: bytes 3-3/*
 				t.Fatal(err)
 			}
 			w.SetOutputHeaders(true)
+			w.now = func() time.Time { return date }
 
 			go w.Start()
 
 			// go WriteResponseWithBoundary(reader, pw, fileName, parts, boundary)
 			expectOut := strings.ReplaceAll(tc.expectOut, "\n", "\r\n")
 
-			respBytes, err := ioutil.ReadAll(w)
+			respBytes, err := io.ReadAll(w)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -133,7 +148,11 @@ Content-Range: bytes 3-3/*
 				fileSize: fmt.Sprintf("%d", len("10110")),
 				ranges:   "bytes=1-2",
 				expectOut: `HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Content-Length: 2
 Content-Range: bytes 1-2/5
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 01`,
 			},
@@ -144,7 +163,11 @@ Content-Range: bytes 1-2/5
 				fileSize: fmt.Sprintf("%d", len("10110")),
 				ranges:   "bytes=2-",
 				expectOut: `HTTP/1.1 206 Partial Content
-Content-Range: bytes 2-/5
+Accept-Ranges: bytes
+Content-Length: 3
+Content-Range: bytes 2-4/5
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 110`,
 			},
@@ -155,7 +178,11 @@ Content-Range: bytes 2-/5
 				fileSize: fmt.Sprintf("%d", len("10110")),
 				ranges:   "bytes=-2",
 				expectOut: `HTTP/1.1 206 Partial Content
-Content-Range: bytes -2/5
+Accept-Ranges: bytes
+Content-Length: 2
+Content-Range: bytes 3-4/5
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 10`,
 			},
@@ -166,7 +193,11 @@ Content-Range: bytes -2/5
 				fileSize: "*",
 				ranges:   "bytes=1-2",
 				expectOut: `HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Content-Length: 2
 Content-Range: bytes 1-2/*
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
 
 01`,
 			},
@@ -185,13 +216,14 @@ Content-Range: bytes 1-2/*
 				t.Fatal(err)
 			}
 			w.SetOutputHeaders(true)
+			w.now = func() time.Time { return date }
 
 			go w.Start()
 
 			// go WriteResponseWithBoundary(reader, pw, fileName, parts, boundary)
 			expectOut := strings.ReplaceAll(tc.expectOut, "\n", "\r\n")
 
-			respBytes, err := ioutil.ReadAll(w)
+			respBytes, err := io.ReadAll(w)
 			if err != nil {
 				t.Fatal(err, 0)
 			}
@@ -210,6 +242,127 @@ Content-Range: bytes 1-2/*
 		}
 	})
 
+	t.Run("full content", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{
+				src:      "10110",
+				dst:      &mockResp{},
+				fileName: fileName,
+				fileSize: fmt.Sprintf("%d", len("10110")),
+				ranges:   "",
+				expectOut: `HTTP/1.1 200 OK
+Accept-Ranges: bytes
+Content-Length: 5
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+
+10110`,
+			},
+			&testCase{
+				src:      "",
+				dst:      &mockResp{},
+				fileName: fileName,
+				fileSize: "*",
+				ranges:   "",
+				expectOut: `HTTP/1.1 200 OK
+Accept-Ranges: bytes
+Content-Length: 0
+Content-Type: application/pdf
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+
+`,
+			},
+		}
+
+		for _, tc := range testCases {
+			reader := NewMockReadSeekCloser(bytes.NewReader([]byte(tc.src)))
+			parts, err := RangeToParts(tc.ranges, ctype, tc.fileSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w, err := NewMultipartReaderWithBoudary(reader, parts, boundary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.SetContentType(ctype)
+			w.SetOutputHeaders(true)
+			w.now = func() time.Time { return date }
+			if w.StatusCode() != 200 {
+				t.Errorf("unexpected status code %d", w.StatusCode())
+			}
+
+			go w.Start()
+
+			expectOut := strings.ReplaceAll(tc.expectOut, "\n", "\r\n")
+			respBytes, err := io.ReadAll(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := string(respBytes)
+			if expectOut != body {
+				t.Error("resp not equal: 1.expect 2.got")
+				t.Error(tc.expectOut)
+				t.Error(body)
+			}
+			if w.ContentLength() != int64(len(tc.src)) {
+				t.Errorf("content length incorrect: expect(%d) got(%d)", len(tc.src), w.ContentLength())
+			}
+		}
+	})
+	t.Run("extra headers", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=1-2", ctype, "5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewMultipartReaderWithBoudary(NewMockReadSeekCloser(bytes.NewReader([]byte("10110"))), parts, boundary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetOutputHeaders(true)
+		w.SetLastModified(date.Add(-time.Hour))
+		for _, header := range [][2]string{{"connection", "close"}, {"ETag", `"v1"`}, {"Date", "Sun, 03 Jan 2021 00:00:00 GMT"}} {
+			if err = w.SetHeader(header[0], header[1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, header := range [][2]string{{"Content-Length", "1"}, {"X-Injected", "a\r\nb"}, {"Bad Key", "a"}} {
+			if err = w.SetHeader(header[0], header[1]); err == nil {
+				t.Errorf("header %s should be rejected", header[0])
+			}
+		}
+
+		go w.Start()
+		respBytes, err := io.ReadAll(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectOut := strings.ReplaceAll(`HTTP/1.1 206 Partial Content
+Accept-Ranges: bytes
+Connection: close
+Content-Length: 2
+Content-Range: bytes 1-2/5
+Content-Type: application/pdf
+Date: Sun, 03 Jan 2021 00:00:00 GMT
+Etag: "v1"
+Last-Modified: Sat, 02 Jan 2021 02:04:05 GMT
+
+01`, "\n", "\r\n")
+		if string(respBytes) != expectOut {
+			t.Error("resp not equal: 1.expect 2.got")
+			t.Error(expectOut)
+			t.Error(string(respBytes))
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 206 || resp.ContentLength != 2 || resp.Close != true {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
 }
 
 type mockResp struct {
@@ -228,3 +381,270 @@ func (r *mockResp) Close() error {
 func (r *mockResp) String() string {
 	return r.body
 }
+
+type failingSource struct {
+	*bytes.Reader
+	size    int64 // the size reported by Size, e.g. the size before the source is truncated
+	seekErr error
+	readErr error
+}
+
+func (fs *failingSource) Size() int64 {
+	if fs.size > 0 {
+		return fs.size
+	}
+	return fs.Reader.Size()
+}
+
+func (fs *failingSource) Seek(offset int64, whence int) (int64, error) {
+	if fs.seekErr != nil {
+		return 0, fs.seekErr
+	}
+	return fs.Reader.Seek(offset, whence)
+}
+
+func (fs *failingSource) Read(p []byte) (int, error) {
+	if fs.readErr != nil {
+		return 0, fs.readErr
+	}
+	return fs.Reader.Read(p)
+}
+
+func (fs *failingSource) Close() error {
+	return nil
+}
+
+func TestMultipartReaderErrors(t *testing.T) {
+	errInjected := errors.New("injected")
+	content := "0123456789"
+
+	type testCase struct {
+		src       *failingSource
+		fileSize  string
+		ranges    string
+		expectErr error
+	}
+
+	start := func(src ReadSeekCloser, ranges, fileSize string) (*MultipartReader, *recordingObserver, chan error) {
+		parts, err := RangeToParts(ranges, "text/plain", fileSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr, err := NewMultipartReaderWithBoudary(src, parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		observer := newRecordingObserver()
+		mr.SetObserver(observer)
+		mr.SetOutputHeaders(true)
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- mr.Start()
+		}()
+		return mr, observer, errCh
+	}
+
+	t.Run("failing sources", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{
+				src:       &failingSource{Reader: bytes.NewReader([]byte(content)), seekErr: errInjected},
+				fileSize:  "10",
+				ranges:    "bytes=1-2",
+				expectErr: errInjected,
+			},
+			&testCase{
+				src:       &failingSource{Reader: bytes.NewReader([]byte(content)), readErr: errInjected},
+				fileSize:  "10",
+				ranges:    "bytes=1-2, 4-5",
+				expectErr: errInjected,
+			},
+			&testCase{
+				src:       &failingSource{Reader: bytes.NewReader([]byte(content)), size: 20},
+				fileSize:  "20",
+				ranges:    "bytes=8-12",
+				expectErr: ErrSourceTruncated,
+			},
+			&testCase{
+				src:       &failingSource{Reader: bytes.NewReader([]byte(content)), size: 20},
+				fileSize:  "20",
+				ranges:    "bytes=0-1, 12-13",
+				expectErr: io.ErrUnexpectedEOF,
+			},
+		}
+
+		for _, tc := range testCases {
+			mr, observer, errCh := start(tc.src, tc.ranges, tc.fileSize)
+			_, readErr := io.ReadAll(mr)
+			startErr := <-errCh
+
+			if !errors.Is(startErr, tc.expectErr) || !errors.Is(readErr, tc.expectErr) || !errors.Is(mr.Err(), tc.expectErr) {
+				t.Errorf("%s: expect(%v) start(%v) read(%v) err(%v)", tc.ranges, tc.expectErr, startErr, readErr, mr.Err())
+			}
+			if len(observer.errs) != 1 {
+				t.Errorf("%s: error should be reported once: %v", tc.ranges, observer.errs)
+			}
+		}
+	})
+
+	t.Run("failing writers", func(t *testing.T) {
+		for _, ranges := range []string{"bytes=1-2", "bytes=1-2, 4-5"} {
+			full := new(bytes.Buffer)
+			mr, _, errCh := start(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), ranges, "10")
+			if _, err := io.Copy(full, mr); err != nil || <-errCh != nil || mr.Err() != nil {
+				t.Fatal(err)
+			}
+
+			// the reader stops after reading n bytes, then writing fails in every step
+			for n := 0; n < full.Len(); n++ {
+				mr, observer, errCh := start(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), ranges, "10")
+				if _, err := io.ReadFull(mr, make([]byte, n)); err != nil {
+					t.Fatal(err)
+				}
+				mr.r.CloseWithError(errInjected)
+
+				if err := <-errCh; err != errInjected || mr.Err() != errInjected {
+					t.Errorf("%s(%d): expect(%v) got(%v)", ranges, n, errInjected, err)
+				}
+				if len(observer.errs) != 1 {
+					t.Errorf("%s(%d): error should be reported once: %v", ranges, n, observer.errs)
+				}
+			}
+		}
+	})
+}
+
+func TestMultipartReaderWriteTo(t *testing.T) {
+	content := "0123456789"
+	for _, ranges := range []string{"", "bytes=1-2", "bytes=1-2, -3"} {
+		newReader := func() *MultipartReader {
+			parts, err := RangeToParts(ranges, "text/plain", "10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderWithBoudary(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr.SetOutputHeaders(true)
+			mr.SetHeader("Date", "Sat, 02 Jan 2021 03:04:05 GMT")
+			return mr
+		}
+
+		mr := newReader()
+		go mr.Start()
+		expectOut, err := io.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// written directly, and Start waits for WriteTo
+		mr = newReader()
+		buf := new(bytes.Buffer)
+		n, err := mr.WriteTo(buf)
+		if err != nil || n != int64(len(expectOut)) || buf.String() != string(expectOut) {
+			t.Errorf("%s: unexpected output of WriteTo(%d, %v)\n%s", ranges, n, err, buf.String())
+		}
+		if err = mr.Start(); err != nil {
+			t.Errorf("%s: Start should return the result of WriteTo: %v", ranges, err)
+		}
+
+		// io.Copy without Start uses WriteTo
+		mr = newReader()
+		buf.Reset()
+		if _, err = io.Copy(buf, mr); err != nil || buf.String() != string(expectOut) {
+			t.Errorf("%s: unexpected output of io.Copy without Start(%v)\n%s", ranges, err, buf.String())
+		}
+		if err = mr.Start(); err != nil {
+			t.Errorf("%s: Start after io.Copy should return its result: %v", ranges, err)
+		}
+
+		// copied from the pipe after Start
+		mr = newReader()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- mr.Start()
+		}()
+		for {
+			mr.mu.Lock()
+			started := mr.started
+			mr.mu.Unlock()
+			if started {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		buf.Reset()
+		if _, err = io.Copy(buf, mr); err != nil || <-errCh != nil || buf.String() != string(expectOut) {
+			t.Errorf("%s: unexpected output of io.Copy(%v)\n%s", ranges, err, buf.String())
+		}
+	}
+}
+
+// BenchmarkMultipartReader compares copying parts of a file to a TCP connection through the pipe,
+// and through WriteTo which lets the connection use sendfile.
+func BenchmarkMultipartReader(b *testing.B) {
+	const fileSize = 16 << 20
+	fd, err := os.CreateTemp(b.TempDir(), "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err = fd.Write(bytes.Repeat([]byte("0123456789abcdef"), fileSize/16)); err != nil {
+		b.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	ranges := "bytes=0-4194303, 8388608-12582911, -4194304"
+	newReader := func(b *testing.B) *MultipartReader {
+		parts, err := RangeToParts(ranges, "application/octet-stream", strconv.Itoa(fileSize))
+		if err != nil {
+			b.Fatal(err)
+		}
+		mr, err := NewMultipartReader(fd, parts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		mr.SetOutputHeaders(true)
+		return mr
+	}
+
+	b.Run("pipe", func(b *testing.B) {
+		b.SetBytes(3 * 4194304)
+		for i := 0; i < b.N; i++ {
+			mr := newReader(b)
+			go mr.Start()
+			if _, err := io.Copy(conn, struct{ io.Reader }{mr}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("write to", func(b *testing.B) {
+		b.SetBytes(3 * 4194304)
+		for i := 0; i < b.N; i++ {
+			if _, err := newReader(b).WriteTo(conn); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
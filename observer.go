@@ -0,0 +1,70 @@
+package multipart
+
+import (
+	"io"
+	"time"
+)
+
+// Observer receives the events of writing parts,
+// methods are called from the goroutine which writes the response.
+type Observer interface {
+	// OnPartStart is called before writing the header of the part at index.
+	OnPartStart(index int, part *Part)
+	// OnPartDone is called after the body of the part is written, written counts the body bytes only.
+	OnPartDone(index int, part *Part, written int64, elapsed time.Duration)
+	// OnError is called once with the error which stops writing, e.g. io.ErrClosedPipe if the reader is closed.
+	OnError(err error)
+	// OnComplete is called after the whole response is written, written counts all bytes including headers.
+	OnComplete(written int64, elapsed time.Duration)
+}
+
+// SeekObserver can be implemented by an Observer to see how the source is accessed.
+type SeekObserver interface {
+	// OnSeek is called before the source is positioned at offset to copy the body of the part at index,
+	// e.g. a Seek of a ReadSeekCloser or an OpenRange of a RangeSource.
+	OnSeek(index int, offset int64)
+}
+
+// NopObserver ignores all events, it can be embedded to implement part of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnPartStart(index int, part *Part)                                      {}
+func (NopObserver) OnPartDone(index int, part *Part, written int64, elapsed time.Duration) {}
+func (NopObserver) OnError(err error)                                                      {}
+func (NopObserver) OnComplete(written int64, elapsed time.Duration)                        {}
+
+func observeSeek(observer Observer, index int, offset int64) {
+	if so, ok := observer.(SeekObserver); ok {
+		so.OnSeek(index, offset)
+	}
+}
+
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the ReadFrom of the underlying writer reachable,
+// e.g. *net.TCPConn uses sendfile if src is an *io.LimitedReader of an *os.File.
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := cw.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{cw.w}, src)
+	}
+	cw.written += n
+	return n, err
+}
+
+// writerOnly hides the ReadFrom of a writer to avoid recursion in io.Copy.
+type writerOnly struct {
+	io.Writer
+}
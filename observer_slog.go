@@ -0,0 +1,52 @@
+package multipart
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SlogObserver logs events with log/slog, part events are logged at debug level.
+type SlogObserver struct {
+	logger *slog.Logger
+}
+
+func NewSlogObserver(logger *slog.Logger) *SlogObserver {
+	return &SlogObserver{logger: logger}
+}
+
+func (so *SlogObserver) OnPartStart(index int, part *Part) {
+	so.logger.LogAttrs(context.Background(), slog.LevelDebug, "part started",
+		slog.Int("index", index),
+		slog.Int64("start", part.Start()),
+		slog.Int64("end", part.End()),
+	)
+}
+
+func (so *SlogObserver) OnPartDone(index int, part *Part, written int64, elapsed time.Duration) {
+	so.logger.LogAttrs(context.Background(), slog.LevelDebug, "part done",
+		slog.Int("index", index),
+		slog.Int64("written", written),
+		slog.Duration("elapsed", elapsed),
+	)
+}
+
+func (so *SlogObserver) OnSeek(index int, offset int64) {
+	so.logger.LogAttrs(context.Background(), slog.LevelDebug, "source seeked",
+		slog.Int("index", index),
+		slog.Int64("offset", offset),
+	)
+}
+
+func (so *SlogObserver) OnError(err error) {
+	so.logger.LogAttrs(context.Background(), slog.LevelError, "writing parts failed",
+		slog.String("error", err.Error()),
+	)
+}
+
+func (so *SlogObserver) OnComplete(written int64, elapsed time.Duration) {
+	so.logger.LogAttrs(context.Background(), slog.LevelInfo, "parts written",
+		slog.Int64("written", written),
+		slog.Duration("elapsed", elapsed),
+	)
+}
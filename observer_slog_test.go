@@ -0,0 +1,34 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogObserver(t *testing.T) {
+	buf := new(bytes.Buffer)
+	observer := NewSlogObserver(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	part := newResolvedPart("text/plain", 1, 2, 10)
+	observer.OnPartStart(0, part)
+	observer.OnSeek(0, 1)
+	observer.OnPartDone(0, part, 2, 0)
+	observer.OnError(errors.New("broken pipe"))
+	observer.OnComplete(100, 0)
+
+	out := buf.String()
+	for _, expected := range []string{
+		`msg="part started" index=0 start=1 end=2`,
+		`msg="source seeked" index=0 offset=1`,
+		`msg="part done" index=0 written=2`,
+		`level=ERROR msg="writing parts failed" error="broken pipe"`,
+		`msg="parts written" written=100`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%s not found in %s", expected, out)
+		}
+	}
+}
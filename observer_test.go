@@ -0,0 +1,153 @@
+package multipart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	events   []string
+	errs     []error
+	written  int64
+	complete chan struct{}
+}
+
+func newRecordingObserver() *recordingObserver {
+	// buffered for more than one event, so repeated OnError calls don't block and can be counted
+	return &recordingObserver{complete: make(chan struct{}, 4)}
+}
+
+func (ro *recordingObserver) OnPartStart(index int, part *Part) {
+	ro.record(fmt.Sprintf("start %d %d-%d", index, part.Start(), part.End()))
+}
+
+func (ro *recordingObserver) OnSeek(index int, offset int64) {
+	ro.record(fmt.Sprintf("seek %d %d", index, offset))
+}
+
+func (ro *recordingObserver) OnPartDone(index int, part *Part, written int64, elapsed time.Duration) {
+	ro.record(fmt.Sprintf("done %d %d", index, written))
+}
+
+func (ro *recordingObserver) OnError(err error) {
+	ro.mu.Lock()
+	ro.errs = append(ro.errs, err)
+	ro.mu.Unlock()
+	ro.complete <- struct{}{}
+}
+
+func (ro *recordingObserver) OnComplete(written int64, elapsed time.Duration) {
+	ro.mu.Lock()
+	ro.written = written
+	ro.mu.Unlock()
+	ro.complete <- struct{}{}
+}
+
+func (ro *recordingObserver) record(event string) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.events = append(ro.events, event)
+}
+
+func TestObserver(t *testing.T) {
+	content := "0123456789"
+
+	type testCase struct {
+		ranges       string
+		expectEvents []string
+	}
+
+	t.Run("events of parts", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{
+				ranges:       "bytes=1-2",
+				expectEvents: []string{"start 0 1-2", "seek 0 1", "done 0 2"},
+			},
+			&testCase{
+				ranges:       "bytes=0-3, 8-",
+				expectEvents: []string{"start 0 0-3", "seek 0 0", "done 0 4", "start 1 8-9", "seek 1 8", "done 1 2"},
+			},
+		}
+
+		for _, tc := range testCases {
+			parts, err := RangeToParts(tc.ranges, "text/plain", fmt.Sprintf("%d", len(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderWithBoudary(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			observer := newRecordingObserver()
+			mr.SetObserver(observer)
+			mr.SetOutputHeaders(true)
+
+			go mr.Start()
+			out, err := io.ReadAll(mr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-observer.complete
+
+			if fmt.Sprint(observer.events) != fmt.Sprint(tc.expectEvents) {
+				t.Errorf("events expect(%v) got(%v)", tc.expectEvents, observer.events)
+			}
+			if observer.written != int64(len(out)) || len(observer.errs) != 0 {
+				t.Errorf("written expect(%d) got(%d), errors(%v)", len(out), observer.written, observer.errs)
+			}
+		}
+	})
+
+	t.Run("closed reader is reported", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=0-3, 8-", "text/plain", fmt.Sprintf("%d", len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr, err := NewMultipartReader(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		observer := newRecordingObserver()
+		mr.SetObserver(observer)
+		mr.SetOutputHeaders(true)
+		mr.Close()
+
+		// writing the status and headers fails, it is reported once
+		if err = mr.Start(); err != io.ErrClosedPipe {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(observer.errs) != 1 || observer.errs[0] != io.ErrClosedPipe {
+			t.Fatalf("unexpected errors %v", observer.errs)
+		}
+	})
+
+	t.Run("transformer events", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=0-3, 8-", "text/plain", fmt.Sprintf("%d", len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm, err := NewTransformer(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		observer := newRecordingObserver()
+		tfm.SetObserver(observer)
+
+		buf := new(bytes.Buffer)
+		if err = tfm.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		<-observer.complete
+		if observer.written != int64(buf.Len()) || int64(buf.Len()) != tfm.ContentLength() {
+			t.Errorf("written(%d) buffer(%d) content length(%d)", observer.written, buf.Len(), tfm.ContentLength())
+		}
+		if len(observer.events) != 6 {
+			t.Errorf("unexpected events %v", observer.events)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package multipart
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Segment is a piece of a response body, it is either literal bytes or the bytes of a part in the source.
+type Segment struct {
+	Literal []byte
+	Part    *Part // it is nil for literal segments
+	Index   int   // index of the part which the segment belongs to, it is -1 for the closing delimiter
+}
+
+func (seg Segment) Len() int64 {
+	if seg.Part != nil {
+		return seg.Part.Len()
+	}
+	return int64(len(seg.Literal))
+}
+
+// Plan is the precomputed layout of a multipart body without the CRLF which terminates the response headers.
+// It is immutable so it can be cached and shared by Transformers of the same parts and boundary.
+type Plan struct {
+	boundary string
+	parts    []*Part
+	segments []Segment
+	length   int64
+}
+
+// NewPlan renders the part headers of parts once, parts should not be changed after it.
+func NewPlan(parts []*Part, boundary string) (*Plan, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no part to plan")
+	} else if err := validateBoundary(boundary); err != nil {
+		return nil, err
+	} else if err = checkParts(parts); err != nil {
+		return nil, err
+	}
+
+	// all literals share one buffer
+	var buf bytes.Buffer
+	offsets := make([]int, 0, len(parts)+1)
+	for _, part := range parts {
+		writePartHeader(&buf, boundary, part)
+		offsets = append(offsets, buf.Len())
+	}
+	fmt.Fprintf(&buf, "\r\n--%s--", boundary)
+	literals := buf.Bytes()
+
+	plan := &Plan{
+		boundary: boundary,
+		parts:    parts,
+		segments: make([]Segment, 0, 2*len(parts)+1),
+	}
+	// the first CRLF is not part of message body
+	// ref: https://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html
+	start := 2
+	for i, part := range parts {
+		plan.segments = append(plan.segments,
+			Segment{Literal: literals[start:offsets[i]:offsets[i]], Index: i},
+			Segment{Part: part, Index: i},
+		)
+		start = offsets[i]
+	}
+	plan.segments = append(plan.segments, Segment{Literal: literals[start:], Index: -1})
+
+	length, ok := int64(0), true
+	for _, seg := range plan.segments {
+		if length, ok = addLength(length, seg.Len()); !ok {
+			return nil, &OverflowError{Op: "content length"}
+		}
+	}
+	plan.length = length
+	return plan, nil
+}
+
+// newWholePlan creates the plan which writes the whole source without boundaries.
+func newWholePlan(part *Part) *Plan {
+	return &Plan{
+		segments: []Segment{{Part: part, Index: 0}},
+		length:   part.Len(),
+	}
+}
+
+func (p *Plan) Boundary() string {
+	return p.boundary
+}
+
+// Segments returns the segments in writing order, literals should not be modified.
+func (p *Plan) Segments() []Segment {
+	return append([]Segment(nil), p.segments...)
+}
+
+// Length returns the length of the body.
+func (p *Plan) Length() int64 {
+	return p.length
+}
+
+// sourceParts returns the parts which are read from the source.
+func (p *Plan) sourceParts() []*Part {
+	parts := make([]*Part, 0, len(p.segments)/2+1)
+	for _, seg := range p.segments {
+		if seg.Part != nil {
+			parts = append(parts, seg.Part)
+		}
+	}
+	return parts
+}
+
+// String describes the segments for debugging.
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, seg := range p.segments {
+		if seg.Part != nil {
+			fmt.Fprintf(&b, "part %d: source %d-%d\n", seg.Index, seg.Part.Start(), seg.Part.End())
+		} else {
+			fmt.Fprintf(&b, "part %d: literal %q\n", seg.Index, seg.Literal)
+		}
+	}
+	fmt.Fprintf(&b, "length: %d", p.length)
+	return b.String()
+}
+
+// PlanCache is a LRU cache of plans, its key should identify the parts and the boundary,
+// e.g. NormalizeRange(rangeHeader, fileSize) with the content type, the file size and the boundary.
+type PlanCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type planEntry struct {
+	key  string
+	plan *Plan
+}
+
+func NewPlanCache(capacity int) *PlanCache {
+	return &PlanCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (pc *PlanCache) Get(key string) (*Plan, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	elem, ok := pc.items[key]
+	if !ok {
+		return nil, false
+	}
+	pc.ll.MoveToFront(elem)
+	return elem.Value.(*planEntry).plan, true
+}
+
+// Add adds a plan and evicts the least recently used one if the cache is full.
+func (pc *PlanCache) Add(key string, plan *Plan) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if elem, ok := pc.items[key]; ok {
+		elem.Value.(*planEntry).plan = plan
+		pc.ll.MoveToFront(elem)
+		return
+	}
+	pc.items[key] = pc.ll.PushFront(&planEntry{key: key, plan: plan})
+	for pc.capacity > 0 && pc.ll.Len() > pc.capacity {
+		oldest := pc.ll.Back()
+		pc.ll.Remove(oldest)
+		delete(pc.items, oldest.Value.(*planEntry).key)
+	}
+}
+
+func (pc *PlanCache) Len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.ll.Len()
+}
@@ -0,0 +1,133 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	content := "0123456789"
+
+	t.Run("segments", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=0-3, -2", "text/plain", "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := NewPlan(parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectOut := `part 0: literal "--BOUNDARY\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes 0-3/10\r\n\r\n"
+part 0: source 0-3
+part 1: literal "\r\n--BOUNDARY\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes 8-9/10\r\n\r\n"
+part 1: source 8-9
+part -1: literal "\r\n--BOUNDARY--"
+length: 188`
+		if plan.String() != expectOut {
+			t.Errorf("not equal 1.expected 2.got\n%s\n%s", expectOut, plan.String())
+		}
+
+		tfm, err := NewTransformerWithPlan(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), plan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err = tfm.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		if plan.Length() != int64(buf.Len()) || tfm.ContentLength() != plan.Length() {
+			t.Errorf("length incorrect: plan(%d) body(%d) transformer(%d)", plan.Length(), buf.Len(), tfm.ContentLength())
+		}
+
+		segments := plan.Segments()
+		segments[0].Literal = nil
+		if plan.Segments()[0].Literal == nil {
+			t.Error("segments should be copied")
+		}
+	})
+
+	t.Run("invalid plans", func(t *testing.T) {
+		parts, err := RangeToParts("bytes=0-3, -2", "text/plain", "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewPlan(nil, "BOUNDARY"); err == nil {
+			t.Error("empty plan should fail")
+		}
+		if _, err = NewPlan(parts, "BOUND\r\nARY"); err == nil {
+			t.Error("invalid boundary should fail")
+		}
+
+		plan, err := NewPlan(parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		shorter := NewMockReadSeekCloser(bytes.NewReader([]byte("012345678")))
+		if _, err = NewTransformerWithPlan(shorter, plan); !errors.Is(err, ErrUnsatisfiableRange) {
+			t.Errorf("plan of a longer source should fail with ErrUnsatisfiableRange: %v", err)
+		}
+	})
+
+	t.Run("normalized range", func(t *testing.T) {
+		type testCase struct {
+			rangeValue string
+			expectOut  string
+		}
+		testCases := []*testCase{
+			&testCase{rangeValue: "bytes=8-9", expectOut: "bytes=8-9"},
+			&testCase{rangeValue: "bytes= 8-", expectOut: "bytes=8-9"},
+			&testCase{rangeValue: "bytes=-2", expectOut: "bytes=8-9"},
+			&testCase{rangeValue: "bytes=-2, 0-0,", expectOut: "bytes=8-9,0-0"},
+			&testCase{rangeValue: "", expectOut: ""},
+		}
+
+		for _, tc := range testCases {
+			out, err := NormalizeRange(tc.rangeValue, "10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != tc.expectOut {
+				t.Errorf("%s: expect(%s) got(%s)", tc.rangeValue, tc.expectOut, out)
+			}
+		}
+		if _, err := NormalizeRange("bytes=10-", "10"); err == nil {
+			t.Error("invalid range should fail")
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		cache := NewPlanCache(2)
+		plans := map[string]*Plan{}
+		for _, rangeValue := range []string{"bytes=0-1, 3-4", "bytes=-2, 0-0", "bytes=1-2, 5-"} {
+			key, err := NormalizeRange(rangeValue, "10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts, err := RangeToParts(rangeValue, "text/plain", "10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan, err := NewPlan(parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plans[key] = plan
+			cache.Add(key, plan)
+			// the first plan becomes the most recently used one so the second one is evicted
+			cache.Get("bytes=0-1,3-4")
+		}
+
+		if cache.Len() != 2 {
+			t.Fatalf("unexpected cache size %d", cache.Len())
+		}
+		for key, expectOK := range map[string]bool{"bytes=0-1,3-4": true, "bytes=8-9,0-0": false, "bytes=1-2,5-9": true} {
+			plan, ok := cache.Get(key)
+			if ok != expectOK || (ok && plan != plans[key]) {
+				t.Errorf("%s: expect cached(%t) got(%t)", key, expectOK, ok)
+			}
+		}
+	})
+}
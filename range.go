@@ -3,6 +3,8 @@ package multipart
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -15,6 +17,7 @@ type Part struct {
 	rangeStartInt int64  // set as -1 if it is empty
 	rangeEndInt   int64  // set as -1 if it is empty
 	fileSizeInt   int64  // set as -1 if it is *
+	disposition   string // formatted Content-Disposition, it could be empty
 }
 
 func NewPart(contentType, rangeStart, rangeEnd, fileSize string) *Part {
@@ -26,6 +29,165 @@ func NewPart(contentType, rangeStart, rangeEnd, fileSize string) *Part {
 	}
 }
 
+// SetContentDisposition adds a Content-Disposition header to the part, see FormatContentDisposition.
+// It should be called before the part is used to create a Plan, a Transformer or a MultipartReader.
+func (p *Part) SetContentDisposition(disposition, fileName string) error {
+	value, err := FormatContentDisposition(disposition, fileName)
+	if err != nil {
+		return err
+	}
+	p.disposition = value
+	return nil
+}
+
+func (p *Part) ContentType() string {
+	return p.contentType
+}
+
+// Start returns the resolved offset of the first byte.
+func (p *Part) Start() int64 {
+	return p.rangeStartInt
+}
+
+// End returns the resolved offset of the last byte.
+func (p *Part) End() int64 {
+	return p.rangeEndInt
+}
+
+// FileSize returns -1 if it is unknown.
+func (p *Part) FileSize() int64 {
+	return p.fileSizeInt
+}
+
+// Len returns the number of bytes in the part.
+func (p *Part) Len() int64 {
+	return p.rangeEndInt - p.rangeStartInt + 1
+}
+
+// newResolvedPart creates a part whose offsets are already checked, fileSize is -1 if it is unknown.
+func newResolvedPart(contentType string, start, end, fileSize int64) *Part {
+	fileSizeStr := "*"
+	if fileSize >= 0 {
+		fileSizeStr = strconv.FormatInt(fileSize, 10)
+	}
+	return &Part{
+		contentType:   contentType,
+		rangeStart:    strconv.FormatInt(start, 10),
+		rangeEnd:      strconv.FormatInt(end, 10),
+		fileSize:      fileSizeStr,
+		rangeStartInt: start,
+		rangeEndInt:   end,
+		fileSizeInt:   fileSize,
+	}
+}
+
+// ParseRange parses a Range header of a source of size bytes strictly, size is -1 if it is unknown.
+// A server should use ParseRangeLenient instead.
+func ParseRange(rangeValue string, size int64) ([]*Part, error) {
+	fileSize := "*"
+	if size >= 0 {
+		fileSize = strconv.FormatInt(size, 10)
+	}
+	return RangeToParts(rangeValue, "", fileSize)
+}
+
+// ParseRangeLenient parses a Range header of a source of size bytes leniently, as RFC 9110 asks a server to.
+// Ranges past the end are clamped to the source and overlapping or adjacent ranges are coalesced,
+// so the parts are never longer than the source, they keep the order of the first range in each of them.
+// Like an empty header, a header of another unit or an invalid one is ignored and no part is returned,
+// so is any header of an empty source. ErrUnsatisfiableRange is returned if no range is in the source.
+func ParseRangeLenient(rangeValue, contentType string, size int64) ([]*Part, error) {
+	const unit = "bytes="
+	if size < 0 {
+		return nil, errors.New("file size is unknown")
+	} else if !strings.HasPrefix(rangeValue, unit) || size == 0 {
+		return nil, nil
+	}
+
+	var intervals []Interval
+	for _, spec := range strings.Split(rangeValue[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		iv, ok := parseLenientSpec(spec, size)
+		if !ok {
+			return nil, nil
+		}
+		intervals = append(intervals, iv)
+	}
+	if len(intervals) == 0 {
+		return nil, nil
+	}
+
+	coalesced := NewRangeSet(intervals...).intervals
+	if len(coalesced) == 0 {
+		return nil, fmt.Errorf("%w: no range is in the %d bytes source", ErrUnsatisfiableRange, size)
+	}
+	parts := make([]*Part, 0, len(coalesced))
+	added := make([]bool, len(coalesced))
+	for _, iv := range intervals {
+		if iv.End < iv.Start {
+			continue
+		}
+		i := sort.Search(len(coalesced), func(i int) bool {
+			return coalesced[i].End >= iv.Start
+		})
+		if !added[i] {
+			added[i] = true
+			parts = append(parts, newResolvedPart(contentType, coalesced[i].Start, coalesced[i].End, size))
+		}
+	}
+	return parts, nil
+}
+
+// parseLenientSpec resolves one range of a Range header, ok is false if it is invalid.
+// A range which is not in the source is returned with End < Start.
+func parseLenientSpec(spec string, size int64) (iv Interval, ok bool) {
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return Interval{}, false
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		suffix, ok := parseLenientPos(last)
+		if !ok {
+			return Interval{}, false
+		} else if suffix > size {
+			suffix = size
+		}
+		return Interval{Start: size - suffix, End: size - 1}, true
+	}
+
+	start, ok := parseLenientPos(first)
+	if !ok {
+		return Interval{}, false
+	}
+	end := int64(math.MaxInt64)
+	if last != "" {
+		if end, ok = parseLenientPos(last); !ok || end < start {
+			return Interval{}, false
+		}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return Interval{Start: start, End: end}, true
+}
+
+// parseLenientPos parses a position of a Range header, a position too large for int64 is math.MaxInt64.
+func parseLenientPos(value string) (int64, bool) {
+	if !isDigits(value) {
+		return 0, false
+	}
+	pos, err := strconv.ParseInt(value, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return math.MaxInt64, true
+	}
+	return pos, err == nil
+}
+
 func RangeToParts(rangeValue string, respContentType, respFileSize string) ([]*Part, error) {
 	if rangeValue == "" {
 		return nil, nil // header not present
@@ -61,10 +223,23 @@ func RangeToParts(rangeValue string, respContentType, respFileSize string) ([]*P
 func checkParts(parts []*Part) error {
 	var err error
 	for _, part := range parts {
+		if part.contentType != "" {
+			if err = validateMediaType(part.contentType); err != nil {
+				return err
+			}
+		}
+		if part.fileSize != "*" && !isDigits(part.fileSize) {
+			return errors.New("invalid file size")
+		} else if part.rangeStart != "" && !isDigits(part.rangeStart) {
+			return errors.New("invalid range start")
+		} else if part.rangeEnd != "" && !isDigits(part.rangeEnd) {
+			return errors.New("invalid range end")
+		}
+
 		if part.fileSize != "*" {
-			part.fileSizeInt, err = strconv.ParseInt(part.fileSize, 10, 64)
+			part.fileSizeInt, err = parseOffset(part.fileSize, "file size")
 			if err != nil {
-				return fmt.Errorf("invalid file size %w", err)
+				return err
 			} else if part.fileSizeInt <= 0 {
 				return errors.New("invalid file size")
 			}
@@ -73,9 +248,9 @@ func checkParts(parts []*Part) error {
 		}
 
 		if part.rangeEnd != "" {
-			part.rangeEndInt, err = strconv.ParseInt(part.rangeEnd, 10, 64)
+			part.rangeEndInt, err = parseOffset(part.rangeEnd, "range end")
 			if err != nil {
-				return fmt.Errorf("invalid range end %w", err)
+				return err
 			} else if part.rangeEndInt < 0 ||
 				(part.fileSize != "*" && part.rangeEndInt >= part.fileSizeInt) {
 				return errors.New("invalid range end")
@@ -100,9 +275,9 @@ func checkParts(parts []*Part) error {
 		}
 
 		if part.rangeStart != "" {
-			part.rangeStartInt, err = strconv.ParseInt(part.rangeStart, 10, 64)
+			part.rangeStartInt, err = parseOffset(part.rangeStart, "range start")
 			if err != nil {
-				return fmt.Errorf("invalid range start %w", err)
+				return err
 			} else if part.rangeStartInt < 0 ||
 				(part.fileSize != "*" && part.rangeStartInt >= part.fileSizeInt) ||
 				(part.rangeEnd != "" && part.rangeStartInt > part.rangeEndInt) {
@@ -111,7 +286,83 @@ func checkParts(parts []*Part) error {
 		} else {
 			part.rangeStartInt = 0
 		}
+
+		// only possible when the file size is unknown, e.g. bytes=0-9223372036854775807
+		if part.rangeEndInt-part.rangeStartInt == math.MaxInt64 {
+			return &OverflowError{Op: "part length"}
+		}
 	}
 
 	return nil
 }
+
+// checkPartsFit checks that checked parts are in a source of size bytes.
+func checkPartsFit(parts []*Part, size int64) error {
+	for i, part := range parts {
+		if part.fileSizeInt >= 0 && part.fileSizeInt != size {
+			return fmt.Errorf("%w: file size of part %d is %d but the source has %d bytes", ErrUnsatisfiableRange, i, part.fileSizeInt, size)
+		} else if part.rangeEndInt >= size {
+			return fmt.Errorf("%w: part %d ends at %d but the source has %d bytes", ErrUnsatisfiableRange, i, part.rangeEndInt, size)
+		}
+	}
+	return nil
+}
+
+// parseOffset parses a non-negative decimal, values larger than math.MaxInt64 cause an OverflowError.
+func parseOffset(value, name string) (int64, error) {
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, &OverflowError{Op: name}
+	} else if err != nil {
+		return 0, fmt.Errorf("invalid %s %w", name, err)
+	}
+	return offset, nil
+}
+
+// NormalizeRange resolves a Range header into a canonical form, e.g. "bytes=-2" of a 10 bytes file is "bytes=8-9",
+// so equivalent headers have the same form. The order of ranges is kept and "" is returned for an empty header.
+func NormalizeRange(rangeValue, fileSize string) (string, error) {
+	parts, err := RangeToParts(rangeValue, "", fileSize)
+	if err != nil || len(parts) == 0 {
+		return "", err
+	}
+
+	specs := make([]string, 0, len(parts))
+	for _, part := range parts {
+		specs = append(specs, strconv.FormatInt(part.rangeStartInt, 10)+"-"+strconv.FormatInt(part.rangeEndInt, 10))
+	}
+	return "bytes=" + strings.Join(specs, ","), nil
+}
+
+// parseContentRange parses a Content-Range value like "bytes 0-9/100", size is -1 if it is *.
+func parseContentRange(value string) (start, end, size int64, err error) {
+	const unit = "bytes "
+	if !strings.HasPrefix(value, unit) {
+		return 0, 0, 0, errors.New("bytes not found in content range")
+	}
+
+	value = value[len(unit):]
+	slash := strings.Index(value, "/")
+	dash := strings.Index(value, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, fmt.Errorf("invalid content range %s", value)
+	}
+
+	if start, err = parseOffset(value[:dash], "content range start"); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = parseOffset(value[dash+1:slash], "content range end"); err != nil {
+		return 0, 0, 0, err
+	}
+	size = -1
+	if value[slash+1:] != "*" {
+		if size, err = parseOffset(value[slash+1:], "content range size"); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	if start < 0 || start > end || end-start == math.MaxInt64 || (size >= 0 && end >= size) {
+		return 0, 0, 0, fmt.Errorf("invalid content range %s", value)
+	}
+	return start, end, size, nil
+}
@@ -0,0 +1,203 @@
+package multipart
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Interval is a closed byte interval [Start, End], the same as a resolved Part.
+type Interval struct {
+	Start int64
+	End   int64
+}
+
+func (iv Interval) Len() int64 {
+	return iv.End - iv.Start + 1
+}
+
+// RangeSet is a sorted and immutable set of disjoint, non-adjacent intervals.
+// The zero value is an empty set.
+type RangeSet struct {
+	intervals []Interval
+}
+
+// NewRangeSet normalizes intervals by sorting them and merging the overlapping or adjacent ones.
+// Intervals whose End is less than Start are ignored.
+func NewRangeSet(intervals ...Interval) RangeSet {
+	sorted := make([]Interval, 0, len(intervals))
+	for _, iv := range intervals {
+		if iv.End >= iv.Start {
+			sorted = append(sorted, iv)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	merged := sorted[:0]
+	for _, iv := range sorted {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.End == math.MaxInt64 || iv.Start <= last.End+1 {
+				if iv.End > last.End {
+					last.End = iv.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, iv)
+	}
+
+	if len(merged) == 0 {
+		return RangeSet{}
+	}
+	return RangeSet{intervals: merged}
+}
+
+func PartsToRangeSet(parts []*Part) RangeSet {
+	intervals := make([]Interval, 0, len(parts))
+	for _, part := range parts {
+		intervals = append(intervals, Interval{Start: part.rangeStartInt, End: part.rangeEndInt})
+	}
+	return NewRangeSet(intervals...)
+}
+
+// ParseRangeSet parses a Range header value into a normalized set.
+// A missing header produces an empty set.
+func ParseRangeSet(rangeValue, fileSize string) (RangeSet, error) {
+	parts, err := RangeToParts(rangeValue, "", fileSize)
+	if err != nil {
+		return RangeSet{}, err
+	}
+	return PartsToRangeSet(parts), nil
+}
+
+// Intervals returns a copy of the normalized intervals.
+func (rs RangeSet) Intervals() []Interval {
+	return append([]Interval(nil), rs.intervals...)
+}
+
+func (rs RangeSet) IsEmpty() bool {
+	return len(rs.intervals) == 0
+}
+
+func (rs RangeSet) Len() int {
+	return len(rs.intervals)
+}
+
+// TotalLength returns the number of bytes in the set, it saturates at math.MaxInt64.
+func (rs RangeSet) TotalLength() int64 {
+	total, ok := int64(0), true
+	for _, iv := range rs.intervals {
+		if total, ok = addLength(total, iv.End-iv.Start); !ok {
+			return math.MaxInt64
+		}
+		if total, ok = addLength(total, 1); !ok {
+			return math.MaxInt64
+		}
+	}
+	return total
+}
+
+// Contains reports whether every byte in [start, end] is in the set.
+func (rs RangeSet) Contains(start, end int64) bool {
+	if end < start {
+		return false
+	}
+	i := sort.Search(len(rs.intervals), func(i int) bool {
+		return rs.intervals[i].End >= start
+	})
+	return i < len(rs.intervals) && rs.intervals[i].Start <= start && rs.intervals[i].End >= end
+}
+
+func (rs RangeSet) Union(other RangeSet) RangeSet {
+	all := make([]Interval, 0, len(rs.intervals)+len(other.intervals))
+	all = append(all, rs.intervals...)
+	all = append(all, other.intervals...)
+	return NewRangeSet(all...)
+}
+
+func (rs RangeSet) Intersect(other RangeSet) RangeSet {
+	var result []Interval
+	i, j := 0, 0
+	for i < len(rs.intervals) && j < len(other.intervals) {
+		a, b := rs.intervals[i], other.intervals[j]
+		start, end := a.Start, a.End
+		if b.Start > start {
+			start = b.Start
+		}
+		if b.End < end {
+			end = b.End
+		}
+		if start <= end {
+			result = append(result, Interval{Start: start, End: end})
+		}
+
+		if a.End < b.End {
+			i++
+		} else {
+			j++
+		}
+	}
+	return NewRangeSet(result...)
+}
+
+func (rs RangeSet) Subtract(other RangeSet) RangeSet {
+	var result []Interval
+	j := 0
+	for _, a := range rs.intervals {
+		for j < len(other.intervals) && other.intervals[j].End < a.Start {
+			j++
+		}
+
+		start, covered := a.Start, false
+		for k := j; k < len(other.intervals) && other.intervals[k].Start <= a.End; k++ {
+			b := other.intervals[k]
+			if b.Start > start {
+				result = append(result, Interval{Start: start, End: b.Start - 1})
+			}
+			if b.End >= a.End {
+				covered = true
+				break
+			}
+			start = b.End + 1
+		}
+
+		if !covered {
+			result = append(result, Interval{Start: start, End: a.End})
+		}
+	}
+	return NewRangeSet(result...)
+}
+
+// Complement returns the gaps of the set within [0, size).
+func (rs RangeSet) Complement(size int64) RangeSet {
+	if size <= 0 {
+		return RangeSet{}
+	}
+	return NewRangeSet(Interval{Start: 0, End: size - 1}).Subtract(rs)
+}
+
+// ToParts converts the set to resolved parts, fileSize is set as -1 if it is unknown.
+func (rs RangeSet) ToParts(contentType string, fileSize int64) []*Part {
+	parts := make([]*Part, 0, len(rs.intervals))
+	for _, iv := range rs.intervals {
+		parts = append(parts, newResolvedPart(contentType, iv.Start, iv.End, fileSize))
+	}
+	return parts
+}
+
+// String formats the set as a Range header value, it returns "" for an empty set.
+func (rs RangeSet) String() string {
+	if len(rs.intervals) == 0 {
+		return ""
+	}
+
+	specs := make([]string, 0, len(rs.intervals))
+	for _, iv := range rs.intervals {
+		specs = append(specs, strconv.FormatInt(iv.Start, 10)+"-"+strconv.FormatInt(iv.End, 10))
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
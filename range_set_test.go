@@ -0,0 +1,179 @@
+package multipart
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+const setModelSize = 64
+
+// setModel is a bitmap model of a RangeSet over [0, setModelSize).
+type setModel [setModelSize]bool
+
+func (m setModel) toRangeSet() RangeSet {
+	var intervals []Interval
+	for i := 0; i < setModelSize; i++ {
+		if m[i] {
+			intervals = append(intervals, Interval{Start: int64(i), End: int64(i)})
+		}
+	}
+	return NewRangeSet(intervals...)
+}
+
+func modelOf(rs RangeSet) setModel {
+	var m setModel
+	for _, iv := range rs.Intervals() {
+		for i := iv.Start; i <= iv.End; i++ {
+			m[i] = true
+		}
+	}
+	return m
+}
+
+type randomIntervals []Interval
+
+func (randomIntervals) Generate(rnd *rand.Rand, size int) reflect.Value {
+	intervals := make(randomIntervals, rnd.Intn(8))
+	for i := range intervals {
+		start := rnd.Int63n(setModelSize)
+		intervals[i] = Interval{Start: start, End: start + rnd.Int63n(setModelSize-start)}
+	}
+	return reflect.ValueOf(intervals)
+}
+
+func checkNormalized(rs RangeSet) bool {
+	intervals := rs.Intervals()
+	for i, iv := range intervals {
+		if iv.End < iv.Start {
+			return false
+		}
+		if i > 0 && iv.Start <= intervals[i-1].End+1 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRangeSet(t *testing.T) {
+	t.Run("normalization", func(t *testing.T) {
+		rs := NewRangeSet(
+			Interval{Start: 8, End: 9},
+			Interval{Start: 0, End: 1},
+			Interval{Start: 2, End: 3},
+			Interval{Start: 5, End: 4},
+			Interval{Start: 6, End: 8},
+		)
+		expected := []Interval{{Start: 0, End: 3}, {Start: 6, End: 9}}
+		if !reflect.DeepEqual(rs.Intervals(), expected) {
+			t.Fatalf("expect(%v) got(%v)", expected, rs.Intervals())
+		}
+		if rs.String() != "bytes=0-3,6-9" {
+			t.Fatalf("unexpected header %s", rs.String())
+		}
+		if rs.TotalLength() != 8 {
+			t.Fatalf("unexpected total length %d", rs.TotalLength())
+		}
+		if (RangeSet{}).String() != "" || !(RangeSet{}).IsEmpty() {
+			t.Fatal("zero value should be empty")
+		}
+	})
+
+	t.Run("operations match bitmap model", func(t *testing.T) {
+		type binaryOp struct {
+			name  string
+			op    func(a, b RangeSet) RangeSet
+			model func(a, b bool) bool
+		}
+		ops := []*binaryOp{
+			&binaryOp{"union", RangeSet.Union, func(a, b bool) bool { return a || b }},
+			&binaryOp{"intersect", RangeSet.Intersect, func(a, b bool) bool { return a && b }},
+			&binaryOp{"subtract", RangeSet.Subtract, func(a, b bool) bool { return a && !b }},
+		}
+
+		for _, bop := range ops {
+			prop := func(ivs1, ivs2 randomIntervals) bool {
+				a, b := NewRangeSet(ivs1...), NewRangeSet(ivs2...)
+				ma, mb := modelOf(a), modelOf(b)
+				var expected setModel
+				for i := range expected {
+					expected[i] = bop.model(ma[i], mb[i])
+				}
+
+				got := bop.op(a, b)
+				return checkNormalized(got) && modelOf(got) == expected
+			}
+			if err := quick.Check(prop, nil); err != nil {
+				t.Errorf("%s: %s", bop.name, err)
+			}
+		}
+	})
+
+	t.Run("complement, contains and total length match bitmap model", func(t *testing.T) {
+		prop := func(ivs randomIntervals, size uint8, start, end uint8) bool {
+			rs := NewRangeSet(ivs...)
+			m := modelOf(rs)
+			complementSize := int64(size % (setModelSize + 1))
+
+			complement := rs.Complement(complementSize)
+			cm := modelOf(complement)
+			total := int64(0)
+			for i := 0; i < setModelSize; i++ {
+				if cm[i] != (int64(i) < complementSize && !m[i]) {
+					return false
+				}
+				if m[i] {
+					total++
+				}
+			}
+
+			s, e := int64(start%setModelSize), int64(end%setModelSize)
+			contains := s <= e
+			for i := s; i <= e; i++ {
+				contains = contains && m[i]
+			}
+
+			return checkNormalized(complement) &&
+				rs.Contains(s, e) == contains &&
+				rs.TotalLength() == total
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("conversions round trip", func(t *testing.T) {
+		prop := func(ivs randomIntervals) bool {
+			rs := NewRangeSet(ivs...)
+			parts := rs.ToParts("text/plain", setModelSize)
+			if !reflect.DeepEqual(PartsToRangeSet(parts), rs) {
+				return false
+			}
+			if rs.IsEmpty() {
+				return rs.String() == ""
+			}
+
+			parsed, err := ParseRangeSet(rs.String(), "64")
+			return err == nil && reflect.DeepEqual(parsed, rs)
+		}
+		if err := quick.Check(prop, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("parse resolves suffix and open ranges", func(t *testing.T) {
+		rs, err := ParseRangeSet("bytes=-2, 0-1, 1-", "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.String() != "bytes=0-9" {
+			t.Fatalf("unexpected set %s", rs.String())
+		}
+
+		parts := rs.ToParts("text/plain", -1)
+		if parts[0].fileSize != "*" || parts[0].rangeStart != "0" || parts[0].rangeEnd != "9" {
+			t.Fatalf("unexpected part %+v", parts[0])
+		}
+	})
+}
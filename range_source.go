@@ -0,0 +1,118 @@
+package multipart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// RangeSource is a source which is read by byte ranges, e.g. an object in an object storage.
+type RangeSource interface {
+	// Size returns the size of the source, it is -1 if the size can not be determined.
+	Size() int64
+	// OpenRange opens a reader of bytes [start, end], the reader ends early if the source is truncated.
+	OpenRange(ctx context.Context, start, end int64) (io.ReadCloser, error)
+}
+
+// ReaderAtSource reads ranges from an io.ReaderAt, ranges can be read concurrently.
+type ReaderAtSource struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func NewReaderAtSource(r io.ReaderAt, size int64) *ReaderAtSource {
+	return &ReaderAtSource{r: r, size: size}
+}
+
+func (ras *ReaderAtSource) Size() int64 {
+	return ras.size
+}
+
+func (ras *ReaderAtSource) OpenRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	if err := checkRange(start, end); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.NewSectionReader(ras.r, start, end-start+1)), nil
+}
+
+// ReadSeekerSource reads ranges from an io.ReadSeeker, only one range can be read at a time
+// because all readers share the offset of the source.
+type ReadSeekerSource struct {
+	src  io.ReadSeeker
+	size int64
+	err  error
+}
+
+// NewReadSeekerSource creates a source whose size is got from Size(), Stat() or seeking at the first use.
+func NewReadSeekerSource(src io.ReadSeeker) *ReadSeekerSource {
+	return &ReadSeekerSource{src: src, size: -1}
+}
+
+func (rss *ReadSeekerSource) Size() int64 {
+	size, _ := rss.loadSize()
+	return size
+}
+
+func (rss *ReadSeekerSource) loadSize() (int64, error) {
+	if rss.size < 0 && rss.err == nil {
+		rss.size, rss.err = sourceSize(rss.src)
+		if rss.err != nil {
+			rss.size = -1
+		}
+	}
+	return rss.size, rss.err
+}
+
+func (rss *ReadSeekerSource) OpenRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	if err := checkRange(start, end); err != nil {
+		return nil, err
+	}
+	if _, err := rss.src.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(io.LimitReader(rss.src, end-start+1)), nil
+}
+
+// rangeSourceSize returns the size of src and the error of determining it.
+func rangeSourceSize(src RangeSource) (int64, error) {
+	if rss, ok := src.(*ReadSeekerSource); ok {
+		return rss.loadSize()
+	}
+	if size := src.Size(); size >= 0 {
+		return size, nil
+	}
+	return -1, errors.New("size of source is unknown")
+}
+
+func checkRange(start, end int64) error {
+	if start < 0 || start > end || end-start == math.MaxInt64 {
+		return fmt.Errorf("%w: bytes %d-%d", ErrUnsatisfiableRange, start, end)
+	}
+	return nil
+}
+
+// copyRange copies the bytes of part from src to dst.
+func copyRange(ctx context.Context, src RangeSource, dst io.Writer, part *Part) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rss, ok := src.(*ReadSeekerSource); ok {
+		// io.CopyN on the source itself keeps sendfile available: net.TCPConn.ReadFrom only recognizes
+		// an *io.LimitedReader of an *os.File, an *io.SectionReader of the file would be copied in user space
+		return writePartBody(rss.src, dst, part)
+	}
+
+	rc, err := src.OpenRange(ctx, part.rangeStartInt, part.rangeEndInt)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	wrote, err := io.CopyN(dst, rc, part.Len())
+	if err == io.EOF {
+		return &SourceTruncatedError{Part: part, Offset: part.rangeStartInt + wrote}
+	}
+	return err
+}
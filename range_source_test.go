@@ -0,0 +1,281 @@
+package multipart
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeObjectStore is an in-memory object store which records the ranges opened.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	sizes   map[string]int64 // advertised sizes, e.g. the size before the object is truncated
+	opened  []string
+	openErr error
+	gate    chan struct{} // OpenRange waits for it if it is not nil
+	waiting int
+	maxWait int // the most OpenRange calls waiting for the gate at the same time
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{
+		objects: map[string][]byte{},
+		sizes:   map[string]int64{},
+	}
+}
+
+func (fs *fakeObjectStore) Put(key string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.objects[key] = data
+	fs.sizes[key] = int64(len(data))
+}
+
+// Truncate keeps the first n bytes of an object but not its advertised size.
+func (fs *fakeObjectStore) Truncate(key string, n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.objects[key] = fs.objects[key][:n]
+}
+
+func (fs *fakeObjectStore) SetSize(key string, size int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.sizes[key] = size
+}
+
+func (fs *fakeObjectStore) SetOpenErr(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.openErr = err
+}
+
+func (fs *fakeObjectStore) SetGate(gate chan struct{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gate = gate
+}
+
+// Opened returns the ranges opened so far.
+func (fs *fakeObjectStore) Opened() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.opened...)
+}
+
+func (fs *fakeObjectStore) Waiting() (waiting, maxWait int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.waiting, fs.maxWait
+}
+
+func (fs *fakeObjectStore) wait() {
+	fs.mu.Lock()
+	gate := fs.gate
+	if gate == nil {
+		fs.mu.Unlock()
+		return
+	}
+	fs.waiting++
+	if fs.waiting > fs.maxWait {
+		fs.maxWait = fs.waiting
+	}
+	fs.mu.Unlock()
+
+	<-gate
+	fs.mu.Lock()
+	fs.waiting--
+	fs.mu.Unlock()
+}
+
+func (fs *fakeObjectStore) Object(key string) RangeSource {
+	return &fakeObject{store: fs, key: key}
+}
+
+type fakeObject struct {
+	store *fakeObjectStore
+	key   string
+}
+
+func (fo *fakeObject) Size() int64 {
+	fo.store.mu.Lock()
+	defer fo.store.mu.Unlock()
+	size, ok := fo.store.sizes[fo.key]
+	if !ok {
+		return -1
+	}
+	return size
+}
+
+func (fo *fakeObject) OpenRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fo.store.wait()
+
+	fo.store.mu.Lock()
+	defer fo.store.mu.Unlock()
+	if fo.store.openErr != nil {
+		return nil, fo.store.openErr
+	}
+	data, ok := fo.store.objects[fo.key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", fo.key)
+	}
+	fo.store.opened = append(fo.store.opened, fmt.Sprintf("%s:%d-%d", fo.key, start, end))
+
+	if start > int64(len(data)) {
+		start = int64(len(data))
+	}
+	if end >= int64(len(data)) {
+		end = int64(len(data)) - 1
+	}
+	return io.NopCloser(bytes.NewReader(data[start : end+1])), nil
+}
+
+func TestRangeSource(t *testing.T) {
+	content := []byte("0123456789")
+	ranges := "bytes=0-1, 4-6, -2"
+
+	expectBody := func(t *testing.T) []byte {
+		parts, err := ParseRange(ranges, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm, err := NewTransformerWithBoundary(NewMockReadSeekCloser(bytes.NewReader(content)), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err = tfm.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}(t)
+
+	t.Run("sources", func(t *testing.T) {
+		store := newFakeObjectStore()
+		store.Put("obj", content)
+		sources := []RangeSource{
+			store.Object("obj"),
+			NewReaderAtSource(bytes.NewReader(content), int64(len(content))),
+			NewReadSeekerSource(bytes.NewReader(content)),
+		}
+
+		for _, src := range sources {
+			if src.Size() != int64(len(content)) {
+				t.Errorf("%T: unexpected size %d", src, src.Size())
+			}
+
+			parts, err := ParseRange(ranges, src.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tfm, err := NewTransformerWithSource(src, parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := new(bytes.Buffer)
+			if err = tfm.WriteBody(buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), expectBody) {
+				t.Errorf("%T: not equal 1.expected 2.got\n%s\n%s", src, expectBody, buf.Bytes())
+			}
+
+			rc, err := src.OpenRange(context.Background(), 3, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			} else if string(out) != "345" {
+				t.Errorf("%T: unexpected range %s", src, out)
+			}
+			rc.Close()
+		}
+
+		expectOpened := []string{"obj:0-1", "obj:4-6", "obj:8-9", "obj:3-5"}
+		if fmt.Sprint(store.opened) != fmt.Sprint(expectOpened) {
+			t.Errorf("each range should be opened once: %v", store.opened)
+		}
+	})
+
+	t.Run("multipart reader", func(t *testing.T) {
+		store := newFakeObjectStore()
+		store.Put("obj", content)
+		for _, rangeValue := range []string{"", "bytes=2-4", ranges} {
+			parts, err := ParseRange(rangeValue, int64(len(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderWithSource(store.Object("obj"), parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go mr.Start()
+			body, err := io.ReadAll(mr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(body)) != mr.ContentLength()+2 {
+				t.Errorf("%s: content length incorrect: expect(%d) got(%d)", rangeValue, mr.ContentLength()+2, len(body))
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		store := newFakeObjectStore()
+		store.Put("obj", content)
+		parts, err := ParseRange(ranges, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = NewTransformerWithSource(store.Object("missing"), parts, "BOUNDARY"); err == nil {
+			t.Error("source of unknown size should fail")
+		}
+		if _, err = NewReaderAtSource(bytes.NewReader(content), 10).OpenRange(context.Background(), 5, 4); !errors.Is(err, ErrUnsatisfiableRange) {
+			t.Errorf("invalid range should fail: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tfm, err := NewTransformerWithSource(store.Object("obj"), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm.SetContext(ctx)
+		if err = tfm.WriteBody(io.Discard); !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		errInjected := errors.New("injected")
+		store.SetOpenErr(errInjected)
+		tfm.SetContext(context.Background())
+		if err = tfm.WriteBody(io.Discard); !errors.Is(err, errInjected) {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		// the object is truncated after its size is advertised
+		store.SetOpenErr(nil)
+		store.Truncate("obj", 5)
+		err = tfm.WriteBody(io.Discard)
+		truncated := &SourceTruncatedError{}
+		if !errors.As(err, &truncated) || truncated.Offset != 5 || truncated.Part.Start() != 4 {
+			t.Errorf("unexpected error %v", err)
+		}
+		tfm.SetPreflightCheck(true)
+		store.SetSize("obj", 5)
+		if err = tfm.WriteBody(io.Discard); !errors.Is(err, ErrSourceTruncated) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package multipart
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -188,4 +190,155 @@ func TestRangeToParts(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("overflow cases", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{
+				rangeValue: "bytes=0-9223372036854775808",
+				ctype:      ctype,
+				fileSize:   "*",
+			},
+			&testCase{
+				rangeValue: "bytes=99999999999999999999-",
+				ctype:      ctype,
+				fileSize:   "9223372036854775807",
+			},
+			&testCase{
+				rangeValue: "bytes=0-1",
+				ctype:      ctype,
+				fileSize:   "9223372036854775808",
+			},
+			&testCase{
+				rangeValue: "bytes=0-9223372036854775807",
+				ctype:      ctype,
+				fileSize:   "*",
+			},
+		}
+
+		for i, tc := range testCases {
+			_, err := RangeToParts(tc.rangeValue, tc.ctype, tc.fileSize)
+			overflowErr := &OverflowError{}
+			if !errors.As(err, &overflowErr) {
+				t.Errorf("case %d should overflow: %v", i, err)
+			}
+		}
+
+		parts, err := RangeToParts("bytes=0-9223372036854775806, -1", ctype, "9223372036854775807")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedOut := []*Part{
+			&Part{
+				rangeStartInt: 0,
+				rangeEndInt:   math.MaxInt64 - 1,
+				fileSizeInt:   math.MaxInt64,
+				contentType:   ctype,
+			},
+			&Part{
+				rangeStartInt: math.MaxInt64 - 1,
+				rangeEndInt:   math.MaxInt64 - 1,
+				fileSizeInt:   math.MaxInt64,
+				contentType:   ctype,
+			},
+		}
+		if err = compareParts(parts, expectedOut); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestParseRange(t *testing.T) {
+	type testCase struct {
+		rangeValue string
+		size       int64
+		expectOut  string
+		expectErr  bool
+	}
+
+	testCases := []*testCase{
+		&testCase{rangeValue: "bytes=0-1, -2", size: 10, expectOut: "0-1/10,8-9/10"},
+		&testCase{rangeValue: "bytes=5-", size: 10, expectOut: "5-9/10"},
+		&testCase{rangeValue: "bytes=0-1", size: -1, expectOut: "0-1/-1"},
+		&testCase{rangeValue: "", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=-2", size: -1, expectErr: true},
+		&testCase{rangeValue: "bytes=10-", size: 10, expectErr: true},
+		&testCase{rangeValue: "bytes=0-1", size: 0, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		parts, err := ParseRange(tc.rangeValue, tc.size)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s: expect error(%t) got(%v)", tc.rangeValue, tc.expectErr, err)
+			continue
+		}
+
+		out := ""
+		for i, part := range parts {
+			if i > 0 {
+				out += ","
+			}
+			out += fmt.Sprintf("%d-%d/%d", part.Start(), part.End(), part.FileSize())
+		}
+		if out != tc.expectOut {
+			t.Errorf("%s: expect(%s) got(%s)", tc.rangeValue, tc.expectOut, out)
+		}
+	}
+}
+
+func TestParseRangeLenient(t *testing.T) {
+	type testCase struct {
+		rangeValue      string
+		size            int64
+		expectOut       string
+		expectUnsatisfy bool
+	}
+
+	testCases := []*testCase{
+		&testCase{rangeValue: "bytes=0-1, -2", size: 10, expectOut: "0-1,8-9"},
+		&testCase{rangeValue: "bytes=-2, 0-1", size: 10, expectOut: "8-9,0-1"},
+		&testCase{rangeValue: "bytes=0-999", size: 10, expectOut: "0-9"},
+		&testCase{rangeValue: "bytes=5-99999999999999999999", size: 10, expectOut: "5-9"},
+		&testCase{rangeValue: "bytes=-10", size: 10, expectOut: "0-9"},
+		&testCase{rangeValue: "bytes=-500", size: 10, expectOut: "0-9"},
+		&testCase{rangeValue: "bytes=0-,0-,0-,0-", size: 10, expectOut: "0-9"},
+		&testCase{rangeValue: "bytes=6-8, 0-1, 2-3, 7-9", size: 10, expectOut: "6-9,0-3"},
+		&testCase{rangeValue: "bytes=20-, 3-4", size: 10, expectOut: "3-4"},
+		&testCase{rangeValue: "bytes= 1 - 2 ,, ", size: 10, expectOut: "1-2"},
+		&testCase{rangeValue: "", size: 10, expectOut: ""},
+		&testCase{rangeValue: "items=0-1", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=5-2", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=0-1, x", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=-1-2", size: 10, expectOut: ""},
+		&testCase{rangeValue: "bytes=0-1", size: 0, expectOut: ""},
+		&testCase{rangeValue: "bytes=10-", size: 10, expectUnsatisfy: true},
+		&testCase{rangeValue: "bytes=-0", size: 10, expectUnsatisfy: true},
+		&testCase{rangeValue: "bytes=99999999999999999999-", size: 10, expectUnsatisfy: true},
+	}
+
+	for _, tc := range testCases {
+		parts, err := ParseRangeLenient(tc.rangeValue, "text/plain", tc.size)
+		if errors.Is(err, ErrUnsatisfiableRange) != tc.expectUnsatisfy || (err != nil && !tc.expectUnsatisfy) {
+			t.Errorf("%s: expect unsatisfiable(%t) got(%v)", tc.rangeValue, tc.expectUnsatisfy, err)
+			continue
+		}
+
+		out := ""
+		for i, part := range parts {
+			if i > 0 {
+				out += ","
+			}
+			out += fmt.Sprintf("%d-%d", part.Start(), part.End())
+			if part.FileSize() != tc.size || part.ContentType() != "text/plain" {
+				t.Errorf("%s: unexpected part of %d bytes file %q", tc.rangeValue, part.FileSize(), part.ContentType())
+			}
+		}
+		if out != tc.expectOut {
+			t.Errorf("%s: expect(%s) got(%s)", tc.rangeValue, tc.expectOut, out)
+		}
+	}
+
+	if _, err := ParseRangeLenient("bytes=0-1", "", -1); err == nil {
+		t.Error("unknown size should fail")
+	}
 }
@@ -1,81 +1,302 @@
 package multipart
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"time"
 )
 
-// TODO: this is introduced in Go 1.16
-type ReadSeekCloser interface {
-	io.Reader
-	io.Seeker
-	io.Closer
-}
+// ReadSeekCloser is kept as an alias of io.ReadSeekCloser for compatibility.
+type ReadSeekCloser = io.ReadSeekCloser
 
 type Transformer struct {
-	src      ReadSeekCloser
-	boundary string
-	parts    []*Part
+	src         RangeSource
+	ctx         context.Context
+	boundary    string
+	parts       []*Part
+	plan        *Plan
+	observer    Observer
+	preflight   bool
+	onTruncated TruncationHandler
+}
+
+func NewTransformer(src ReadSeekCloser, parts []*Part) (*Transformer, error) {
+	return NewTransformerWithGenerator(src, parts, RandomBoundaryGenerator{})
+}
+
+// NewTransformerFromRange parses the Range header with the size of src by ParseRangeLenient,
+// the whole source is written if the header is empty or ignored.
+func NewTransformerFromRange(src ReadSeekCloser, rangeValue string) (*Transformer, error) {
+	size, err := sourceSize(src)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := ParseRangeLenient(rangeValue, "", size)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransformer(src, parts)
 }
 
-func NewTransformer(src ReadSeekCloser, parts []*Part) *Transformer {
-	boundary := randomBoundary()
+// NewTransformerWithGenerator uses the boundary generated by gen.
+func NewTransformerWithGenerator(src ReadSeekCloser, parts []*Part, gen BoundaryGenerator) (*Transformer, error) {
+	boundary, err := gen.Boundary(parts)
+	if err != nil {
+		return nil, err
+	}
 	return NewTransformerWithBoundary(src, parts, boundary)
 }
 
-func NewTransformerWithBoundary(src ReadSeekCloser, parts []*Part, boundary string) *Transformer {
-	return &Transformer{
+// NewTransformerWithBoundary returns an error if the boundary or any part can not be written safely,
+// or ErrUnsatisfiableRange if any part is not in src.
+func NewTransformerWithBoundary(src ReadSeekCloser, parts []*Part, boundary string) (*Transformer, error) {
+	return NewTransformerWithSource(NewReadSeekerSource(src), parts, boundary)
+}
+
+// NewTransformerWithSource creates a transformer which streams parts from a RangeSource.
+func NewTransformerWithSource(src RangeSource, parts []*Part, boundary string) (*Transformer, error) {
+	if err := validateBoundary(boundary); err != nil {
+		return nil, err
+	} else if err = checkParts(parts); err != nil {
+		return nil, err
+	}
+	if len(parts) > 0 {
+		size, err := rangeSourceSize(src)
+		if err != nil {
+			return nil, err
+		} else if err = checkPartsFit(parts, size); err != nil {
+			return nil, err
+		}
+	}
+
+	tfm := &Transformer{
 		src:      src,
+		ctx:      context.Background(),
 		boundary: boundary,
 		parts:    parts,
+		observer: NopObserver{},
 	}
+	if len(parts) > 0 {
+		plan, err := NewPlan(parts, boundary)
+		if err != nil {
+			return nil, err
+		}
+		tfm.plan = plan
+	}
+	return tfm, nil
 }
 
-func (tfm *Transformer) SetBoundary(boundary string) {
+// NewTransformerWithPlan creates a transformer from a precomputed plan, e.g. one from a PlanCache,
+// ErrUnsatisfiableRange is returned if any part of the plan is not in src.
+func NewTransformerWithPlan(src ReadSeekCloser, plan *Plan) (*Transformer, error) {
+	rs := NewReadSeekerSource(src)
+	size, err := rangeSourceSize(rs)
+	if err != nil {
+		return nil, err
+	} else if err = checkPartsFit(plan.sourceParts(), size); err != nil {
+		return nil, err
+	}
+
+	return &Transformer{
+		src:      rs,
+		ctx:      context.Background(),
+		boundary: plan.boundary,
+		parts:    plan.parts,
+		plan:     plan,
+		observer: NopObserver{},
+	}, nil
+}
+
+func (tfm *Transformer) SetBoundary(boundary string) error {
+	if len(tfm.parts) == 0 {
+		if err := validateBoundary(boundary); err != nil {
+			return err
+		}
+		tfm.boundary = boundary
+		return nil
+	}
+
+	plan, err := NewPlan(tfm.parts, boundary)
+	if err != nil {
+		return err
+	}
 	tfm.boundary = boundary
+	tfm.plan = plan
+	return nil
 }
 
-func (tfm *Transformer) ContentLength() int64 {
-	var buf bytes.Buffer
-	partsBodyLen := int64(0)
+// VerifyBoundary scans the parts in the source and makes sure the boundary doesn't appear in them.
+// If it appears, a new boundary is generated by gen for at most retries times,
+// ErrBoundaryConflict is returned if gen is nil or all boundaries conflict.
+// It reads all parts once so it should be called before writing and only when the boundary is not random.
+func (tfm *Transformer) VerifyBoundary(gen BoundaryGenerator, retries int) error {
+	for i := 0; ; i++ {
+		index, err := findDelimiter(tfm.ctx, tfm.src, tfm.parts, tfm.boundary)
+		if err != nil {
+			return err
+		} else if index < 0 {
+			return nil
+		} else if gen == nil || i >= retries {
+			return fmt.Errorf("%w: part %d contains %q", ErrBoundaryConflict, index, tfm.boundary)
+		}
+
+		boundary, err := gen.Boundary(tfm.parts)
+		if err != nil {
+			return err
+		} else if err = tfm.SetBoundary(boundary); err != nil {
+			return err
+		}
+	}
+}
+
+func (tfm *Transformer) SetObserver(observer Observer) {
+	tfm.observer = observer
+}
 
-	for _, part := range tfm.parts {
-		partsBodyLen += part.rangeEndInt - part.rangeStartInt + 1
-		tfm.WritePartHeader(&buf, part)
+// SetContext sets the context passed to RangeSource.OpenRange, writing stops once it is done.
+func (tfm *Transformer) SetContext(ctx context.Context) {
+	tfm.ctx = ctx
+}
+
+// SetPreflightCheck enables checking the size of the source before writing,
+// so a truncated source fails with a SourceTruncatedError before any byte is written.
+func (tfm *Transformer) SetPreflightCheck(check bool) {
+	tfm.preflight = check
+}
+
+// SetTruncationHandler sets the handler called when the source ends in the middle of a part,
+// the error is returned without it.
+func (tfm *Transformer) SetTruncationHandler(handler TruncationHandler) {
+	tfm.onTruncated = handler
+}
+
+// Plan returns the plan used for both ContentLength and writing, if there is no part,
+// it is computed from the size of the source.
+func (tfm *Transformer) Plan() (*Plan, error) {
+	if tfm.plan != nil {
+		return tfm.plan, nil
 	}
-	fmt.Fprintf(&buf, "\r\n--%s--", tfm.boundary)
-	partsHeaderLen := int64(buf.Len())
 
-	// the first CRLF is not part of message body
-	// ref: https://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html
-	return partsHeaderLen + partsBodyLen - 2
+	size, err := rangeSourceSize(tfm.src)
+	if err != nil {
+		return nil, err
+	}
+	tfm.plan = newWholePlan(newResolvedPart("", 0, size-1, size))
+	return tfm.plan, nil
+}
+
+// ContentLength returns the size of the source if there is no part,
+// it is -1 if the length is unknown.
+func (tfm *Transformer) ContentLength() int64 {
+	plan, err := tfm.Plan()
+	if err != nil {
+		return -1
+	}
+	return plan.Length()
 }
 
 func (tfm *Transformer) WritePartHeader(buf io.Writer, part *Part) error {
-	fmt.Fprintf(buf, "\r\n--%s\r\n", tfm.boundary)
-	fmt.Fprint(buf, "Content-Type: application/octet-stream\r\n")
-	fmt.Fprintf(buf, "Content-Range: bytes %s-%s/%s\r\n", part.rangeStart, part.rangeEnd, part.fileSize)
-	fmt.Fprint(buf, "\r\n")
+	return writePartHeader(buf, tfm.boundary, part)
+}
 
-	return nil
+func writePartHeader(buf io.Writer, boundary string, part *Part) error {
+	var err error
+	write := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(buf, format, args...)
+		}
+	}
+
+	write("\r\n--%s\r\n", boundary)
+	write("Content-Type: application/octet-stream\r\n")
+	write("Content-Range: bytes %d-%d/%s\r\n", part.rangeStartInt, part.rangeEndInt, part.fileSize)
+	if part.disposition != "" {
+		write("Content-Disposition: %s\r\n", part.disposition)
+	}
+	write("\r\n")
+	return err
 }
 
+// WriteMultiParts writes parts with the CRLF which terminates the response headers,
+// the whole source is written without boundaries if there is no part.
 func (tfm *Transformer) WriteMultiParts(wt io.Writer) error {
-	var err error
-	for _, part := range tfm.parts {
-		if err = tfm.WritePartHeader(wt, part); err != nil {
+	_, err := tfm.observe(wt, true)
+	return err
+}
+
+// WriteBody writes the multipart body only, its length equals to ContentLength().
+func (tfm *Transformer) WriteBody(wt io.Writer) error {
+	_, err := tfm.observe(wt, false)
+	return err
+}
+
+// WriteTo writes the same bytes as WriteBody. Headers are written into wt directly and bodies are copied by
+// io.Copy, so wt.ReadFrom can use sendfile/splice if the source is an *os.File and wt is a *net.TCPConn.
+func (tfm *Transformer) WriteTo(wt io.Writer) (int64, error) {
+	return tfm.observe(wt, false)
+}
+
+func (tfm *Transformer) observe(wt io.Writer, leadingCRLF bool) (int64, error) {
+	start := time.Now()
+	cw := &countingWriter{w: wt}
+	if err := tfm.writeParts(cw, leadingCRLF); err != nil {
+		tfm.observer.OnError(err)
+		return cw.written, err
+	}
+	tfm.observer.OnComplete(cw.written, time.Since(start))
+	return cw.written, nil
+}
+
+func (tfm *Transformer) writeParts(wt io.Writer, leadingCRLF bool) error {
+	plan, err := tfm.Plan()
+	if err != nil {
+		return err
+	}
+	if tfm.preflight {
+		if err = checkSourceSize(tfm.src, plan.sourceParts()); err != nil {
 			return err
 		}
-		if err = writePartBody(tfm.src, wt, part); err != nil {
+	}
+
+	if leadingCRLF {
+		if _, err = wt.Write([]byte("\r\n")); err != nil {
 			return err
 		}
 	}
 
-	_, err = fmt.Fprintf(wt, "\r\n--%s--", tfm.boundary)
-	if err != nil {
-		return err
-	}
+	current, partStart := -1, time.Now()
+	for _, seg := range plan.segments {
+		if seg.Index >= 0 && seg.Index != current {
+			current, partStart = seg.Index, time.Now()
+			part := seg.Part
+			if part == nil {
+				part = plan.parts[seg.Index]
+			}
+			tfm.observer.OnPartStart(seg.Index, part)
+			tfm.prefetch(plan, seg.Index+1)
+		}
 
+		if seg.Part == nil {
+			if _, err = wt.Write(seg.Literal); err != nil {
+				return err
+			}
+			continue
+		}
+		observeSeek(tfm.observer, seg.Index, seg.Part.rangeStartInt)
+		if err = copyRange(tfm.ctx, tfm.src, wt, seg.Part); err != nil {
+			if err = handleTruncation(tfm.onTruncated, wt, err); err != nil {
+				return err
+			}
+		}
+		tfm.observer.OnPartDone(seg.Index, seg.Part, seg.Part.Len(), time.Since(partStart))
+	}
 	return nil
 }
+
+// prefetch starts loading the part at index if the source is a Prefetcher.
+func (tfm *Transformer) prefetch(plan *Plan, index int) {
+	if pf, ok := tfm.src.(Prefetcher); ok && index < len(plan.parts) {
+		pf.Prefetch(tfm.ctx, plan.parts[index].rangeStartInt, plan.parts[index].rangeEndInt)
+	}
+}
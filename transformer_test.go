@@ -2,8 +2,13 @@ package multipart
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
+	"mime/multipart"
+	"os"
+	"strconv"
 	"testing"
 )
 
@@ -18,6 +23,48 @@ func (rc *MockReadSeekCloser) Close() error {
 	return nil
 }
 
+// patternSource is a virtual file whose byte at offset i is i % 251, it can be as large as math.MaxInt64.
+type patternSource struct {
+	size int64
+	off  int64
+}
+
+func patternByte(off int64) byte {
+	return byte(off % 251)
+}
+
+func (ps *patternSource) Read(p []byte) (int, error) {
+	if ps.off >= ps.size {
+		return 0, io.EOF
+	}
+	if remain := ps.size - ps.off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	for i := range p {
+		p[i] = patternByte(ps.off + int64(i))
+	}
+	ps.off += int64(len(p))
+	return len(p), nil
+}
+
+func (ps *patternSource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += ps.off
+	case io.SeekEnd:
+		offset += ps.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	ps.off = offset
+	return offset, nil
+}
+
+func (ps *patternSource) Close() error {
+	return nil
+}
+
 func TestTransformer(t *testing.T) {
 	type HttpRange struct {
 		contentType string
@@ -50,7 +97,10 @@ func TestTransformer(t *testing.T) {
 			}
 
 			mockFd := &MockReadSeekCloser{bytes.NewReader([]byte(tc.content))}
-			w := NewTransformerWithBoundary(mockFd, parts, sep)
+			w, err := NewTransformerWithBoundary(mockFd, parts, sep)
+			if err != nil {
+				t.Fatal(err)
+			}
 
 			buf := bytes.NewBuffer([]byte{})
 			err = w.WriteMultiParts(buf)
@@ -58,7 +108,7 @@ func TestTransformer(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			respBytes, err := ioutil.ReadAll(buf)
+			respBytes, err := io.ReadAll(buf)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -69,4 +119,263 @@ func TestTransformer(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("large sources", func(t *testing.T) {
+		type largeCase struct {
+			fileSize    int64
+			rangeHeader string
+		}
+		testCases := []*largeCase{
+			&largeCase{fileSize: 5 << 30, rangeHeader: "bytes=4294967290-4294967301, -5"},
+			&largeCase{fileSize: math.MaxInt64, rangeHeader: "bytes=9223372036854775800-, 0-2, -3"},
+		}
+
+		for _, tc := range testCases {
+			fileSize := strconv.FormatInt(tc.fileSize, 10)
+			parts, err := RangeToParts(tc.rangeHeader, "application/octet-stream", fileSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w, err := NewTransformerWithBoundary(&patternSource{size: tc.fileSize}, parts, sep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := new(bytes.Buffer)
+			if err = w.WriteBody(buf); err != nil {
+				t.Fatal(err)
+			}
+			if w.ContentLength() != int64(buf.Len()) {
+				t.Errorf("content length incorrect: expect(%d) got(%d)", buf.Len(), w.ContentLength())
+			}
+
+			mpr := multipart.NewReader(buf, sep)
+			for _, part := range parts {
+				mp, err := mpr.NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(mp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, b := range body {
+					if b != patternByte(part.Start()+int64(i)) {
+						t.Fatalf("unexpected byte at %d", part.Start()+int64(i))
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("sparse file larger than 4 GiB", func(t *testing.T) {
+		fd, err := os.CreateTemp(t.TempDir(), "sparse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		const fileSize = 5<<30 + 7
+		if err = fd.Truncate(fileSize); err != nil {
+			t.Skip(err)
+		}
+		if _, err = fd.WriteAt([]byte("4GiB"), 4<<30); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fd.WriteAt([]byte("end"), fileSize-3); err != nil {
+			t.Fatal(err)
+		}
+
+		parts, err := RangeToParts("bytes=4294967295-4294967299, -3", "application/octet-stream", strconv.FormatInt(fileSize, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewTransformerWithBoundary(fd, parts, sep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err = w.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		expectedOut := "--BOUNDARY\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes 4294967295-4294967299/5368709127\r\n\r\n\x004GiB\r\n--BOUNDARY\r\nContent-Type: application/octet-stream\r\nContent-Range: bytes 5368709124-5368709126/5368709127\r\n\r\nend\r\n--BOUNDARY--"
+		if buf.String() != expectedOut {
+			t.Errorf("not equal 1.expected 2.got\n%q\n%q", expectedOut, buf.String())
+		}
+		if w.ContentLength() != int64(buf.Len()) {
+			t.Errorf("content length incorrect: expect(%d) got(%d)", buf.Len(), w.ContentLength())
+		}
+	})
+
+	t.Run("overflowed content length", func(t *testing.T) {
+		rangeHeaders := []string{
+			"bytes=0-9223372036854775806, 0-9223372036854775806",
+			"bytes=0-, 0-",
+			"bytes=1-, -9223372036854775806",
+		}
+		for _, rangeHeader := range rangeHeaders {
+			parts, err := RangeToParts(rangeHeader, "application/octet-stream", "9223372036854775807")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			overflowErr := &OverflowError{}
+			src := &patternSource{size: math.MaxInt64}
+			if _, err = NewTransformerWithBoundary(src, parts, sep); !errors.As(err, &overflowErr) {
+				t.Errorf("%s: transformer should overflow: %v", rangeHeader, err)
+			}
+			if _, err = NewMultipartReaderWithBoudary(src, parts, sep); !errors.As(err, &overflowErr) {
+				t.Errorf("%s: reader should overflow: %v", rangeHeader, err)
+			}
+		}
+	})
+
+	t.Run("no part", func(t *testing.T) {
+		content := "0123456789"
+		mockFd := &MockReadSeekCloser{bytes.NewReader([]byte(content))}
+		w, err := NewTransformerWithBoundary(mockFd, nil, sep)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+		if err = w.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != content {
+			t.Errorf("not equal 1.expected 2.got\n%s\n%s", content, buf.String())
+		}
+		if w.ContentLength() != int64(len(content)) {
+			t.Errorf("content length incorrect: expect(%d) got(%d)", len(content), w.ContentLength())
+		}
+	})
+
+	t.Run("size from source", func(t *testing.T) {
+		content := "0123456789"
+		fd, err := os.CreateTemp(t.TempDir(), "source")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		if _, err = fd.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+
+		sources := map[io.Seeker]int64{
+			fd:                            10,
+			io.NewSectionReader(fd, 2, 8): 8,
+			&MockReadSeekCloser{bytes.NewReader([]byte(content))}: 10,
+			&patternSource{size: 10}:                              10,
+		}
+		for src, expectSize := range sources {
+			if size, err := sourceSize(src); err != nil {
+				t.Fatal(err)
+			} else if size != expectSize {
+				t.Errorf("%T: expect size(%d) got(%d)", src, expectSize, size)
+			}
+		}
+
+		w, err := NewTransformerFromRange(fd, "bytes=-2, 0-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err = w.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		reader := multipart.NewReader(buf, w.boundary)
+		for _, expectOut := range []string{"89", "01"} {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			} else if string(body) != expectOut {
+				t.Errorf("expect(%s) got(%s)", expectOut, body)
+			}
+		}
+
+		mr, err := NewMultipartReaderFromRange(fd, "")
+		if err != nil {
+			t.Fatal(err)
+		} else if mr.StatusCode() != 200 || mr.ContentLength() != int64(len(content)) {
+			t.Errorf("unexpected status(%d) length(%d)", mr.StatusCode(), mr.ContentLength())
+		}
+		if _, err = NewTransformerFromRange(fd, "bytes=10-"); !errors.Is(err, ErrUnsatisfiableRange) {
+			t.Errorf("range out of source should fail: %v", err)
+		}
+
+		// ranges are parsed leniently like a server does, expect is the status and the number of parts
+		for rangeValue, expect := range map[string]string{"bytes=0-999": "206 1", "bytes=-500, 2-3": "206 1", "bytes=5-2": "200 0", "bytes=8-, 1-2": "206 2"} {
+			mr, err := NewMultipartReaderFromRange(fd, rangeValue)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%d %d", mr.StatusCode(), len(mr.parts)); got != expect {
+				t.Errorf("%s: expect(%s) got(%s)", rangeValue, expect, got)
+			}
+		}
+	})
+
+	t.Run("parts out of source", func(t *testing.T) {
+		src := &MockReadSeekCloser{bytes.NewReader([]byte("0123456789"))}
+		for _, fileSize := range []string{"20", "*"} {
+			parts, err := RangeToParts("bytes=0-1, 8-12", "application/octet-stream", fileSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewTransformerWithBoundary(src, parts, sep); !errors.Is(err, ErrUnsatisfiableRange) {
+				t.Errorf("%s: transformer should fail: %v", fileSize, err)
+			}
+			if _, err = NewMultipartReaderWithBoudary(src, parts, sep); !errors.Is(err, ErrUnsatisfiableRange) {
+				t.Errorf("%s: reader should fail: %v", fileSize, err)
+			}
+		}
+	})
+}
+
+func BenchmarkTransformer(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	rangeHeader := "bytes=0-99, 200-299, 400-499, 600-699, 800-899, 1000-1099, 1200-1299, 1400-1499, -100, 5000-"
+	parts, err := RangeToParts(rangeHeader, "application/octet-stream", strconv.Itoa(len(content)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	src := &MockReadSeekCloser{bytes.NewReader(content)}
+
+	b.Run("new plan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tfm, err := NewTransformerWithBoundary(src, parts, "BOUNDARY")
+			if err != nil {
+				b.Fatal(err)
+			}
+			tfm.ContentLength()
+			if err = tfm.WriteBody(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached plan", func(b *testing.B) {
+		plan, err := NewPlan(parts, "BOUNDARY")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tfm, err := NewTransformerWithPlan(src, plan)
+			if err != nil {
+				b.Fatal(err)
+			}
+			tfm.ContentLength()
+			if err = tfm.WriteBody(io.Discard); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
 }
@@ -0,0 +1,112 @@
+package multipart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrSourceTruncated = errors.New("source is truncated")
+
+// SourceTruncatedError is returned when the source ends in a part, it matches ErrSourceTruncated
+// and io.ErrUnexpectedEOF in errors.Is.
+type SourceTruncatedError struct {
+	Part   *Part
+	Offset int64 // offset where the source ends, it is in [Part.Start(), Part.End()]
+}
+
+func (e *SourceTruncatedError) Error() string {
+	return fmt.Sprintf("%s at %d while writing bytes %d-%d", ErrSourceTruncated, e.Offset, e.Part.rangeStartInt, e.Part.rangeEndInt)
+}
+
+func (e *SourceTruncatedError) Is(target error) bool {
+	return target == ErrSourceTruncated
+}
+
+func (e *SourceTruncatedError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// TruncationPolicy decides what to do after a part is truncated in the middle of a response.
+type TruncationPolicy int
+
+const (
+	// TruncationFail stops writing and returns the error, it is the default.
+	TruncationFail TruncationPolicy = iota
+	// TruncationAbort also closes the destination if it is an io.Closer, e.g. a net.Conn or an io.PipeWriter,
+	// so the client can not mistake the short body for a complete one.
+	// In an http.Handler, panicking with http.ErrAbortHandler in the handler has the same effect.
+	TruncationAbort
+	// TruncationPad writes zeros in place of the missing bytes and continues,
+	// the length of the response is kept but its content is wrong.
+	TruncationPad
+)
+
+// TruncationHandler is called with the truncation error and returns the policy to apply.
+type TruncationHandler func(err *SourceTruncatedError) TruncationPolicy
+
+// handleTruncation applies the policy of handler to err, which is returned by writePartBody into dst.
+func handleTruncation(handler TruncationHandler, dst io.Writer, err error) error {
+	var truncated *SourceTruncatedError
+	if handler == nil || !errors.As(err, &truncated) {
+		return err
+	}
+
+	switch handler(truncated) {
+	case TruncationPad:
+		_, padErr := io.CopyN(dst, zeroReader{}, truncated.Part.rangeEndInt-truncated.Offset+1)
+		return padErr
+	case TruncationAbort:
+		closeWriter(dst, err)
+	}
+	return err
+}
+
+// closeWriter closes dst or the writer wrapped by it with err.
+func closeWriter(dst io.Writer, err error) {
+	if cw, ok := dst.(*countingWriter); ok {
+		dst = cw.w
+	}
+
+	switch w := dst.(type) {
+	case interface{ CloseWithError(error) error }:
+		w.CloseWithError(err)
+	case io.Closer:
+		w.Close()
+	}
+}
+
+// checkSourceSize returns a SourceTruncatedError for the first part which is not in src,
+// the size of a ReadSeekerSource is got by seeking because Size() of the underlying source may be stale.
+func checkSourceSize(src RangeSource, parts []*Part) error {
+	var size int64
+	var err error
+	if rss, ok := src.(*ReadSeekerSource); ok {
+		size, err = seekSize(rss.src)
+	} else {
+		size, err = rangeSourceSize(src)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if part.rangeEndInt >= size {
+			offset := size
+			if offset < part.rangeStartInt {
+				offset = part.rangeStartInt
+			}
+			return &SourceTruncatedError{Part: part, Offset: offset}
+		}
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,145 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// closingBuffer records whether it is closed.
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (cb *closingBuffer) Close() error {
+	cb.closed = true
+	return nil
+}
+
+func TestSourceTruncation(t *testing.T) {
+	content := "0123456789"
+	// the source claims 20 bytes but only 10 bytes can be read
+	newSource := func() *failingSource {
+		return &failingSource{Reader: bytes.NewReader([]byte(content)), size: 20}
+	}
+	newTransformer := func(ranges string) *Transformer {
+		parts, err := ParseRange(ranges, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfm, err := NewTransformerWithBoundary(newSource(), parts, "BOUNDARY")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tfm
+	}
+
+	t.Run("error", func(t *testing.T) {
+		tfm := newTransformer("bytes=0-1, 8-12")
+		var got *SourceTruncatedError
+		tfm.SetTruncationHandler(func(err *SourceTruncatedError) TruncationPolicy {
+			got = err
+			return TruncationFail
+		})
+
+		err := tfm.WriteBody(io.Discard)
+		if !errors.Is(err, ErrSourceTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		truncated := &SourceTruncatedError{}
+		if !errors.As(err, &truncated) || truncated != got {
+			t.Fatalf("handler should receive the error: %v", got)
+		}
+		if truncated.Offset != 10 || truncated.Part.Start() != 8 || truncated.Part.End() != 12 {
+			t.Errorf("unexpected offsets: %d %d-%d", truncated.Offset, truncated.Part.Start(), truncated.Part.End())
+		}
+	})
+
+	t.Run("pad", func(t *testing.T) {
+		tfm := newTransformer("bytes=0-1, 8-12, 15-16")
+		tfm.SetTruncationHandler(func(err *SourceTruncatedError) TruncationPolicy {
+			return TruncationPad
+		})
+
+		buf := new(bytes.Buffer)
+		if err := tfm.WriteBody(buf); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != tfm.ContentLength() {
+			t.Errorf("content length incorrect: expect(%d) got(%d)", tfm.ContentLength(), buf.Len())
+		}
+		if !strings.Contains(buf.String(), "\r\n\r\n89\x00\x00\x00\r\n") || !strings.Contains(buf.String(), "\r\n\r\n\x00\x00\r\n") {
+			t.Errorf("parts should be padded: %q", buf.String())
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		tfm := newTransformer("bytes=0-1, 8-12")
+		tfm.SetTruncationHandler(func(err *SourceTruncatedError) TruncationPolicy {
+			return TruncationAbort
+		})
+
+		dst := &closingBuffer{}
+		if err := tfm.WriteBody(dst); !errors.Is(err, ErrSourceTruncated) {
+			t.Errorf("unexpected error %v", err)
+		}
+		if !dst.closed {
+			t.Error("destination should be closed")
+		}
+
+		// the reader of a pipe gets the error instead of EOF
+		parts, err := ParseRange("bytes=8-12", 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr, err := NewMultipartReader(newSource(), parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.SetTruncationHandler(func(err *SourceTruncatedError) TruncationPolicy {
+			return TruncationAbort
+		})
+		go mr.Start()
+		if _, err = io.ReadAll(mr); !errors.Is(err, ErrSourceTruncated) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		tfm := newTransformer("bytes=0-1, 12-13")
+		tfm.SetPreflightCheck(true)
+		buf := new(bytes.Buffer)
+		err := tfm.WriteBody(buf)
+		truncated := &SourceTruncatedError{}
+		if !errors.As(err, &truncated) || truncated.Offset != 12 {
+			t.Errorf("unexpected error %v", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("nothing should be written: %q", buf.String())
+		}
+
+		for _, ranges := range []string{"", "bytes=8-12", "bytes=0-1, 8-12"} {
+			parts, err := ParseRange(ranges, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr, err := NewMultipartReaderWithBoudary(newSource(), parts, "BOUNDARY")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr.SetOutputHeaders(true)
+			mr.SetPreflightCheck(true)
+
+			buf := new(bytes.Buffer)
+			if _, err = mr.WriteTo(buf); !errors.Is(err, ErrSourceTruncated) {
+				t.Errorf("%s: unexpected error %v", ranges, err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%s: nothing should be written: %q", ranges, buf.String())
+			}
+		}
+	})
+}
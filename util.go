@@ -2,41 +2,66 @@ package multipart
 
 import (
 	"bytes"
-	"crypto/rand"
-	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"net/textproto"
 	"os"
 	"sort"
+	"strconv"
+	"time"
 )
 
-// func writeErrResponse(dst IPipeWriter, statusCode int, respErr error) {
-// 	var err error
-// 	switch statusCode {
-// 	case 400:
-// 		_, err = dst.Write([]byte(fmt.Sprintf("HTTP/1.1 400 Bad Request\r\n%s", respErr)))
-// 	case 500:
-// 		_, err = dst.Write([]byte(fmt.Sprintf("HTTP/1.1 500 Internal Server Error\r\n%s", respErr)))
-// 	}
-
-// 	if err != nil {
-// 		if err == io.ErrClosedPipe {
-// 			panic(ErrClosed(err))
-// 		} else {
-// 			dst.CloseWithError(err)
-// 		}
-// 	}
-// }
-
-func writeStatus(dst *bytes.Buffer, statusCode int) error {
-	var err error
-	switch statusCode {
-	case 200:
-		_, err = dst.Write([]byte("HTTP/1.1 200 OK\r\n"))
-	case 206:
-		_, err = dst.Write([]byte("HTTP/1.1 206 Partial Content\r\n"))
+// writeStatus writes the status line of statusCode, the reason phrase is empty if it is unknown.
+func writeStatus(dst io.Writer, statusCode int) error {
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("invalid status code %d", statusCode)
 	}
+	_, err := fmt.Fprintf(dst, "HTTP/1.1 %03d %s\r\n", statusCode, http.StatusText(statusCode))
+	return err
+}
+
+// bodyAllowed reports whether a response of statusCode can have a body, ref: RFC 7230 section 3.3.
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != 204 && statusCode != 304
+}
+
+// WriteErrorResponse writes a complete plain text response including the status line, it is used
+// when a request can not be served in the raw output mode, e.g. 416 with "Content-Range: bytes */<size>".
+// Headers in headers are written too, and the body is omitted for statuses which forbid it, e.g. 304.
+func WriteErrorResponse(dst io.Writer, statusCode int, headers textproto.MIMEHeader, message string) error {
+	respHeaders := textproto.MIMEHeader{}
+	for key, values := range headers {
+		for _, value := range values {
+			if err := validateHeader(key, value); err != nil {
+				return err
+			}
+			respHeaders.Add(key, value)
+		}
+	}
+	if respHeaders.Get("Date") == "" {
+		respHeaders.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if bodyAllowed(statusCode) {
+		respHeaders.Set("Content-Type", "text/plain; charset=utf-8")
+		respHeaders.Set("Content-Length", strconv.Itoa(len(message)))
+		respHeaders.Set("X-Content-Type-Options", "nosniff")
+	} else {
+		message = ""
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeStatus(buf, statusCode); err != nil {
+		return err
+	}
+	if err := writeHeaders(buf, respHeaders); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(message)
+
+	_, err := buf.WriteTo(dst)
 	return err
 }
 
@@ -61,26 +86,104 @@ func writeHeaders(buf *bytes.Buffer, headers textproto.MIMEHeader) error {
 }
 
 func writePartBody(src io.ReadSeeker, dst io.Writer, part *Part) error {
-	_, err := src.Seek(part.rangeStartInt, os.SEEK_SET)
+	_, err := src.Seek(part.rangeStartInt, io.SeekStart)
 	if err != nil {
 		return err
 	}
 
 	rangeLen := part.rangeEndInt - part.rangeStartInt + 1
 	wrote, err := io.CopyN(dst, src, rangeLen)
+	if err == io.EOF {
+		return &SourceTruncatedError{Part: part, Offset: part.rangeStartInt + wrote}
+	}
+	return err
+}
+
+// serveParts writes the response of parts of src, which has size bytes, or of the whole src if there is no part.
+// The body is not written for HEAD. Once the status is sent, a failed body aborts the response
+// with http.ErrAbortHandler so the client can tell that the body is incomplete.
+func serveParts(w http.ResponseWriter, r *http.Request, src ReadSeekCloser, size int64, contentType string, parts []*Part) {
+	header := w.Header()
+	var err error
+	switch len(parts) {
+	case 0:
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, err = io.CopyN(w, src, size)
+		}
+	case 1:
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.FormatInt(parts[0].Len(), 10))
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", parts[0].Start(), parts[0].End(), size))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodGet {
+			err = writePartBody(src, w, parts[0])
+		}
+	default:
+		var tfm *Transformer
+		if tfm, err = NewTransformer(src, parts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		header.Set("Content-Type", multipartContentType(tfm.boundary))
+		header.Set("Content-Length", strconv.FormatInt(tfm.ContentLength(), 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodGet {
+			err = tfm.WriteBody(w)
+		}
+	}
 	if err != nil {
-		return err
-	} else if wrote != rangeLen {
-		return errors.New("request range length is larger than file size")
+		panic(http.ErrAbortHandler)
 	}
-	return nil
 }
 
-func randomBoundary() string {
-	var buf [30]byte
-	_, err := io.ReadFull(rand.Reader, buf[:])
+// multipartContentType quotes the boundary if it is not a token.
+func multipartContentType(boundary string) string {
+	return mime.FormatMediaType("multipart/byteranges", map[string]string{"boundary": boundary})
+}
+
+// sourceSize returns the size of src from Size() (e.g. *bytes.Reader and *io.SectionReader),
+// Stat() of regular files or seeking to its end.
+func sourceSize(src io.Seeker) (int64, error) {
+	switch s := src.(type) {
+	case interface{ Size() int64 }:
+		return s.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := s.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size(), nil
+		}
+	}
+	return seekSize(src)
+}
+
+// seekSize returns the size of src by seeking to its end, the offset is restored to the start.
+func seekSize(src io.Seeker) (int64, error) {
+	size, err := src.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return fmt.Sprintf("%x", buf[:])
+	_, err = src.Seek(0, io.SeekStart)
+	return size, err
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nc nopCloser) Close() error {
+	return nil
+}
+
+// offsetWriter turns sequential writes into WriteAt calls starting from off.
+type offsetWriter struct {
+	dst io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.dst.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
 }
@@ -0,0 +1,129 @@
+package multipart
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestWriteStatus(t *testing.T) {
+	type testCase struct {
+		statusCode int
+		expectOut  string
+		expectErr  bool
+	}
+
+	testCases := []*testCase{
+		&testCase{statusCode: 200, expectOut: "HTTP/1.1 200 OK\r\n"},
+		&testCase{statusCode: 206, expectOut: "HTTP/1.1 206 Partial Content\r\n"},
+		&testCase{statusCode: 304, expectOut: "HTTP/1.1 304 Not Modified\r\n"},
+		&testCase{statusCode: 400, expectOut: "HTTP/1.1 400 Bad Request\r\n"},
+		&testCase{statusCode: 412, expectOut: "HTTP/1.1 412 Precondition Failed\r\n"},
+		&testCase{statusCode: 416, expectOut: "HTTP/1.1 416 Requested Range Not Satisfiable\r\n"},
+		&testCase{statusCode: 500, expectOut: "HTTP/1.1 500 Internal Server Error\r\n"},
+		&testCase{statusCode: 599, expectOut: "HTTP/1.1 599 \r\n"},
+		&testCase{statusCode: 42, expectErr: true},
+		&testCase{statusCode: 1000, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		buf := new(bytes.Buffer)
+		err := writeStatus(buf, tc.statusCode)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%d should fail", tc.statusCode)
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expectOut {
+			t.Errorf("status line expect(%q) got(%q)", tc.expectOut, buf.String())
+		}
+	}
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	type testCase struct {
+		statusCode int
+		headers    textproto.MIMEHeader
+		message    string
+		expectOut  string
+	}
+
+	date := "Sat, 02 Jan 2021 03:04:05 GMT"
+	testCases := []*testCase{
+		&testCase{
+			statusCode: 416,
+			headers:    textproto.MIMEHeader{"Content-Range": {"bytes */5"}, "Date": {date}},
+			message:    "invalid range",
+			expectOut: `HTTP/1.1 416 Requested Range Not Satisfiable
+Content-Length: 13
+Content-Range: bytes */5
+Content-Type: text/plain; charset=utf-8
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+X-Content-Type-Options: nosniff
+
+invalid range`,
+		},
+		&testCase{
+			statusCode: 304,
+			headers:    textproto.MIMEHeader{"Etag": {`"v1"`}, "Date": {date}},
+			message:    "ignored",
+			expectOut: `HTTP/1.1 304 Not Modified
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+Etag: "v1"
+
+`,
+		},
+		&testCase{
+			statusCode: 500,
+			headers:    textproto.MIMEHeader{"Date": {date}},
+			message:    "",
+			expectOut: `HTTP/1.1 500 Internal Server Error
+Content-Length: 0
+Content-Type: text/plain; charset=utf-8
+Date: Sat, 02 Jan 2021 03:04:05 GMT
+X-Content-Type-Options: nosniff
+
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		buf := new(bytes.Buffer)
+		if err := WriteErrorResponse(buf, tc.statusCode, tc.headers, tc.message); err != nil {
+			t.Fatal(err)
+		}
+		expectOut := strings.ReplaceAll(tc.expectOut, "\n", "\r\n")
+		if buf.String() != expectOut {
+			t.Error("resp not equal: 1.expect 2.got")
+			t.Error(expectOut)
+			t.Error(buf.String())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.statusCode || (tc.statusCode != 304 && string(body) != tc.message) {
+			t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+
+	headers := textproto.MIMEHeader{"X-Injected": {"a\r\n\r\nb"}}
+	if err := WriteErrorResponse(new(bytes.Buffer), 400, headers, "bad request"); err == nil {
+		t.Error("invalid header should be rejected")
+	}
+	if err := WriteErrorResponse(new(bytes.Buffer), 42, nil, "bad request"); err == nil {
+		t.Error("invalid status code should be rejected")
+	}
+}
@@ -0,0 +1,160 @@
+package multipart
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrInvalidBoundary    = errors.New("invalid boundary")
+	ErrInvalidMediaType   = errors.New("invalid media type")
+	ErrInvalidHeader      = errors.New("invalid header")
+	ErrBoundaryConflict   = errors.New("boundary appears in part content")
+	ErrUnsatisfiableRange = errors.New("range is not satisfiable")
+)
+
+const maxBoundaryLen = 70
+
+// OverflowError is returned when an offset or a length can not be represented by int64.
+type OverflowError struct {
+	Op string // the value being computed, e.g. "content length"
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("%s overflows int64", e.Op)
+}
+
+// addLength adds two non-negative lengths, ok is false if the sum overflows.
+func addLength(a, b int64) (sum int64, ok bool) {
+	if a > math.MaxInt64-b {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// validateBoundary checks boundary according to RFC 2046 section 5.1.1.
+func validateBoundary(boundary string) error {
+	if len(boundary) == 0 || len(boundary) > maxBoundaryLen {
+		return fmt.Errorf("%w: length should be in [1, %d]", ErrInvalidBoundary, maxBoundaryLen)
+	} else if boundary[len(boundary)-1] == ' ' {
+		return fmt.Errorf("%w: ends with space", ErrInvalidBoundary)
+	}
+
+	for i := 0; i < len(boundary); i++ {
+		if !isBoundaryChar(boundary[i]) {
+			return fmt.Errorf("%w: character %q is not allowed", ErrInvalidBoundary, boundary[i])
+		}
+	}
+	return nil
+}
+
+func isBoundaryChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("'()+_,-./:=? ", c) >= 0
+}
+
+// validateMediaType checks that mediaType is type "/" subtype *( OWS ";" OWS token "=" ( token / quoted-string ) ),
+// according to RFC 7231 section 3.1.1.1.
+func validateMediaType(mediaType string) error {
+	rest, ok := consumeToken(mediaType)
+	if !ok || !strings.HasPrefix(rest, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidMediaType, mediaType)
+	}
+	if rest, ok = consumeToken(rest[1:]); !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidMediaType, mediaType)
+	}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return nil
+		} else if rest[0] != ';' {
+			return fmt.Errorf("%w: %q", ErrInvalidMediaType, mediaType)
+		}
+
+		rest = strings.TrimLeft(rest[1:], " \t")
+		if rest, ok = consumeToken(rest); !ok || !strings.HasPrefix(rest, "=") {
+			return fmt.Errorf("%w: %q", ErrInvalidMediaType, mediaType)
+		}
+
+		rest = rest[1:]
+		if strings.HasPrefix(rest, `"`) {
+			rest, ok = consumeQuotedString(rest)
+		} else {
+			rest, ok = consumeToken(rest)
+		}
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrInvalidMediaType, mediaType)
+		}
+	}
+}
+
+// consumeToken removes a non-empty token from the start of s.
+func consumeToken(s string) (string, bool) {
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	return s[i:], i > 0
+}
+
+// consumeQuotedString removes a quoted string from the start of s.
+func consumeQuotedString(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return s[i+1:], true
+		case c == '\\':
+			i++
+			if i >= len(s) || !isQuotedChar(s[i]) {
+				return s, false
+			}
+		case !isQuotedChar(c):
+			return s, false
+		}
+	}
+	return s, false
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isQuotedChar reports whether c is HTAB, SP, VCHAR or obs-text.
+func isQuotedChar(c byte) bool {
+	return c == '\t' || c == ' ' || (0x21 <= c && c != 0x7f)
+}
+
+// validateHeader checks that key is a token and value contains no control character except HTAB.
+func validateHeader(key, value string) error {
+	if rest, ok := consumeToken(key); !ok || rest != "" {
+		return fmt.Errorf("%w: key %q", ErrInvalidHeader, key)
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return fmt.Errorf("%w: value of %s contains %q", ErrInvalidHeader, key, c)
+		}
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
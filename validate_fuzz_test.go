@@ -0,0 +1,89 @@
+package multipart
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func FuzzValidateBoundary(f *testing.F) {
+	for _, seed := range []string{"BOUNDARY", "a b", "B\r\nX: 1", "", strings.Repeat("a", 71)} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, boundary string) {
+		if validateBoundary(boundary) != nil {
+			return
+		}
+		if strings.ContainsAny(boundary, "\r\n") || len(boundary) > maxBoundaryLen {
+			t.Fatalf("invalid boundary %q is accepted", boundary)
+		}
+		if err := multipart.NewWriter(io.Discard).SetBoundary(boundary); err != nil {
+			t.Fatalf("boundary %q is rejected by mime/multipart: %s", boundary, err)
+		}
+
+		_, params, err := mime.ParseMediaType(multipartContentType(boundary))
+		if err != nil || params["boundary"] != boundary {
+			t.Fatalf("boundary %q is not preserved in content type: %v", boundary, err)
+		}
+	})
+}
+
+func FuzzValidateMediaType(f *testing.F) {
+	for _, seed := range []string{"text/plain", `text/plain; a="b\"c"`, "text/plain\r\nX: 1", "a/b;c=d;e=f"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, mediaType string) {
+		if validateMediaType(mediaType) != nil {
+			return
+		}
+		for i := 0; i < len(mediaType); i++ {
+			if c := mediaType[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+				t.Fatalf("control character is accepted in %q", mediaType)
+			}
+		}
+	})
+}
+
+func FuzzMultipartReaderOutput(f *testing.F) {
+	f.Add("bytes=0-1, 3-4", "text/plain", "BOUNDARY")
+	f.Add("bytes=-3", "text/plain\r\nX: 1", "B")
+	f.Add("bytes=1-", "a/b", "B\r\n\r\n--B")
+
+	f.Fuzz(func(t *testing.T, ranges, contentType, boundary string) {
+		content := "0123456789"
+		parts, err := RangeToParts(ranges, contentType, "10")
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		mr, err := NewMultipartReaderWithBoudary(NewMockReadSeekCloser(bytes.NewReader([]byte(content))), parts, boundary)
+		if err != nil {
+			return
+		}
+		go mr.Start()
+		out, err := io.ReadAll(mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every part is parsed back with exactly its own headers
+		mpr := multipart.NewReader(bytes.NewReader(out), boundary)
+		for i := range parts {
+			part, err := mpr.NextPart()
+			if err != nil {
+				t.Fatalf("part %d: %s", i, err)
+			}
+			if len(part.Header) != 2 {
+				t.Fatalf("part %d: unexpected headers %v", i, part.Header)
+			}
+			body, err := io.ReadAll(part)
+			if err != nil || int64(len(body)) != parts[i].Len() {
+				t.Fatalf("part %d: unexpected body %q %v", i, body, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type testCase struct {
+		value string
+		valid bool
+	}
+
+	t.Run("boundaries", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{value: "BOUNDARY", valid: true},
+			&testCase{value: strings.Repeat("0123456789abcdef", 4)[:60], valid: true},
+			&testCase{value: "gc0p4Jq0M2Yt08j34c0p'()+_,-./:=? x", valid: true},
+			&testCase{value: strings.Repeat("a", 70), valid: true},
+			&testCase{value: strings.Repeat("a", 71), valid: false},
+			&testCase{value: "", valid: false},
+			&testCase{value: "BOUNDARY ", valid: false},
+			&testCase{value: "BOUND\r\nARY", valid: false},
+			&testCase{value: "BOUND\"ARY", valid: false},
+			&testCase{value: "BOUND;ARY", valid: false},
+		}
+
+		for _, tc := range testCases {
+			err := validateBoundary(tc.value)
+			if (err == nil) != tc.valid {
+				t.Errorf("%q: expect valid(%t) got(%v)", tc.value, tc.valid, err)
+			} else if err != nil && !errors.Is(err, ErrInvalidBoundary) {
+				t.Errorf("%q: unexpected error %v", tc.value, err)
+			}
+		}
+	})
+
+	t.Run("media types", func(t *testing.T) {
+		testCases := []*testCase{
+			&testCase{value: "application/pdf", valid: true},
+			&testCase{value: "text/plain;charset=utf-8", valid: true},
+			&testCase{value: "text/plain ; charset=\"utf-8\"; format=flowed", valid: true},
+			&testCase{value: `text/plain; name="a \"b\" c"`, valid: true},
+			&testCase{value: "application/vnd.api+json", valid: true},
+			&testCase{value: "", valid: false},
+			&testCase{value: "text", valid: false},
+			&testCase{value: "text/", valid: false},
+			&testCase{value: "text/plain;", valid: false},
+			&testCase{value: "text/plain; charset", valid: false},
+			&testCase{value: `text/plain; name="unterminated`, valid: false},
+			&testCase{value: "text/plain\r\nX-Injected: 1", valid: false},
+			&testCase{value: "text/plain; name=\"a\r\nb\"", valid: false},
+			&testCase{value: "text/plain\r\n\r\n--BOUNDARY", valid: false},
+		}
+
+		for _, tc := range testCases {
+			err := validateMediaType(tc.value)
+			if (err == nil) != tc.valid {
+				t.Errorf("%q: expect valid(%t) got(%v)", tc.value, tc.valid, err)
+			} else if err != nil && !errors.Is(err, ErrInvalidMediaType) {
+				t.Errorf("%q: unexpected error %v", tc.value, err)
+			}
+		}
+	})
+
+	t.Run("constructors reject injection", func(t *testing.T) {
+		src := NewMockReadSeekCloser(bytes.NewReader([]byte("0123456789")))
+		parts, err := RangeToParts("bytes=0-1, 3-4", "text/plain", "10")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = NewMultipartReaderWithBoudary(src, parts, "B\r\nX-Injected: 1"); !errors.Is(err, ErrInvalidBoundary) {
+			t.Errorf("boundary should be rejected: %v", err)
+		}
+		if _, err = NewTransformerWithBoundary(src, parts, "B\r\n"); !errors.Is(err, ErrInvalidBoundary) {
+			t.Errorf("boundary should be rejected: %v", err)
+		}
+
+		tfm, err := NewTransformer(src, parts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tfm.SetBoundary("B\r\n"); !errors.Is(err, ErrInvalidBoundary) {
+			t.Errorf("boundary should be rejected: %v", err)
+		}
+
+		if _, err = RangeToParts("bytes=0-1", "text/plain\r\nX-Injected: 1", "10"); !errors.Is(err, ErrInvalidMediaType) {
+			t.Errorf("content type should be rejected: %v", err)
+		}
+		if _, err = NewTransformer(src, []*Part{NewPart("text/plain", "0", "1", "10\r\nX-Injected: 1")}); err == nil {
+			t.Error("file size should be rejected")
+		}
+		if _, err = NewTransformer(src, []*Part{NewPart("text/plain", "+0", "1", "10")}); err == nil {
+			t.Error("range start should be rejected")
+		}
+
+		mr, err := NewMultipartReader(src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mr.SetContentType("text/html\r\nSet-Cookie: a=b"); !errors.Is(err, ErrInvalidMediaType) {
+			t.Errorf("content type should be rejected: %v", err)
+		}
+	})
+}